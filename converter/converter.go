@@ -13,6 +13,7 @@ import (
 type Converter interface {
 	Translate() (string, error)
 	TranslateWithTimeRange() (string, *influxql.TimeRange, error)
+	TranslateWithMetadata() (string, *translator.Metadata, error)
 }
 
 type converter struct {
@@ -20,18 +21,24 @@ type converter struct {
 	translator   translator.Translator
 }
 
-func Translate(influxQL string) (string, error) {
-	return New(strings.NewReader(influxQL)).Translate()
+func Translate(influxQL string, opts ...translator.Option) (string, error) {
+	return New(strings.NewReader(influxQL), opts...).Translate()
 }
 
-func TranslateWithTimeRange(influxQL string) (string, *influxql.TimeRange, error) {
-	return New(strings.NewReader(influxQL)).TranslateWithTimeRange()
+func TranslateWithTimeRange(influxQL string, opts ...translator.Option) (string, *influxql.TimeRange, error) {
+	return New(strings.NewReader(influxQL), opts...).TranslateWithTimeRange()
 }
 
-func New(r io.Reader) Converter {
+func TranslateWithMetadata(influxQL string, opts ...translator.Option) (string, *translator.Metadata, error) {
+	return New(strings.NewReader(influxQL), opts...).TranslateWithMetadata()
+}
+
+// New creates a Converter reading the InfluxQL statement from r, the options
+// customize the translation, e.g. translator.WithTopkFlavour(translator.TOPK_FLAVOUR_MAX).
+func New(r io.Reader, opts ...translator.Option) Converter {
 	c := &converter{
 		influxParser: influxql.NewParser(r),
-		translator:   translator.NewPromQL(),
+		translator:   translator.NewPromQL(opts...),
 	}
 	return c
 }
@@ -54,3 +61,11 @@ func (c converter) TranslateWithTimeRange() (string, *influxql.TimeRange, error)
 	}
 	return promQL, c.translator.GetTimeRange(), nil
 }
+
+func (c converter) TranslateWithMetadata() (string, *translator.Metadata, error) {
+	promQL, err := c.Translate()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Translate")
+	}
+	return promQL, c.translator.GetMetadata(), nil
+}
@@ -0,0 +1,311 @@
+package translator
+
+import (
+	"github.com/influxdata/influxql"
+	"github.com/influxdata/promql/v2"
+	"github.com/influxdata/promql/v2/pkg/labels"
+	"github.com/pkg/errors"
+)
+
+// MAX_LABEL_FILTERS limits the groups of matchers the tag conditions expand
+// into, as distributing AND over OR grows exponentially.
+const MAX_LABEL_FILTERS = 100
+
+// labelFilters are the label matchers of the tag conditions in disjunctive
+// normal form, the series matching any group of matchers are selected, e.g.
+// (a = '1' OR b = '2') AND c = '3' => [[a="1", c="3"], [b="2", c="3"]].
+type labelFilters [][]*labels.Matcher
+
+// withMatcher returns the filters requiring the matcher in each group.
+func (f labelFilters) withMatcher(matcher *labels.Matcher) labelFilters {
+	result := make(labelFilters, len(f))
+	for i, ls := range f {
+		result[i] = append(append(make([]*labels.Matcher, 0, len(ls)+1), ls...), matcher)
+	}
+	return result
+}
+
+// withMetricName returns the filters selecting the metric name instead of the
+// metric name of the filters.
+func (f labelFilters) withMetricName(metricName string) labelFilters {
+	result := make(labelFilters, len(f))
+	for i, ls := range f {
+		result[i] = replaceMetricNameMatcher(ls, metricName)
+	}
+	return result
+}
+
+// getLabelFilters normalizes the tag conditions into disjunctive normal form
+// by distributing AND over OR.
+func (m promQL) getLabelFilters(cond influxql.Expr) (labelFilters, error) {
+	switch e := cond.(type) {
+	case nil:
+		return labelFilters{{}}, nil
+	case *influxql.ParenExpr:
+		return m.getLabelFilters(e.Expr)
+	case *influxql.BinaryExpr:
+		switch e.Op {
+		case influxql.AND, influxql.OR:
+			lhs, err := m.getLabelFilters(e.LHS)
+			if err != nil {
+				return nil, err
+			}
+			rhs, err := m.getLabelFilters(e.RHS)
+			if err != nil {
+				return nil, err
+			}
+			size := len(lhs) * len(rhs)
+			if e.Op == influxql.OR {
+				size = len(lhs) + len(rhs)
+			}
+			if size > MAX_LABEL_FILTERS {
+				return nil, errors.Errorf("tag conditions %s expand into more than %d groups of matchers", cond, MAX_LABEL_FILTERS)
+			}
+			if e.Op == influxql.OR {
+				return append(lhs, rhs...), nil
+			}
+			result := make(labelFilters, 0, len(lhs)*len(rhs))
+			for _, l := range lhs {
+				for _, r := range rhs {
+					result = append(result, append(append(make([]*labels.Matcher, 0, len(l)+len(r)), l...), r...))
+				}
+			}
+			return result, nil
+		}
+		matcher, err := m.getLabelMatcher(e)
+		if err != nil {
+			return nil, err
+		}
+		return labelFilters{{matcher}}, nil
+	}
+	return nil, errors.Errorf("not supported condition %s", cond)
+}
+
+// getLabelMatcher translates the comparison of a tag into label matcher.
+func (m promQL) getLabelMatcher(expr *influxql.BinaryExpr) (*labels.Matcher, error) {
+	ref, ok := expr.LHS.(*influxql.VarRef)
+	value := expr.RHS
+	if !ok {
+		// 'server01' = host => host = 'server01'
+		if ref, ok = expr.RHS.(*influxql.VarRef); !ok {
+			return nil, errors.Errorf("condition %s doesn't compare a tag", expr)
+		}
+		value = expr.LHS
+	}
+	if isFieldType(m.getKeyType(ref)) {
+		return nil, errors.Errorf("field %s can't be matched as a tag", ref.Val)
+	}
+	var val string
+	switch v := value.(type) {
+	case *influxql.StringLiteral:
+		val = v.Val
+	case *influxql.RegexLiteral:
+		val = unanchorRegex(v.Val.String())
+	default:
+		return nil, errors.Errorf("tag %s can't be compared with %s", ref.Val, value)
+	}
+	var matchType labels.MatchType
+	switch expr.Op {
+	case influxql.EQ:
+		matchType = labels.MatchEqual
+	case influxql.NEQ:
+		matchType = labels.MatchNotEqual
+	case influxql.EQREGEX:
+		matchType = labels.MatchRegexp
+	case influxql.NEQREGEX:
+		matchType = labels.MatchNotRegexp
+	default:
+		return nil, errors.Errorf("Not suport influxdb operator: %s", expr.Op)
+	}
+	matcher, err := labels.NewMatcher(matchType, m.sanitizeLabelName(ref.Val), val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "not supported operator: %q", expr.Op)
+	}
+	return matcher, nil
+}
+
+// fieldCondition is a WHERE predicate on the values of a field, e.g. usage_idle < 10.
+type fieldCondition struct {
+	field      string
+	metricName string
+	op         promql.ItemType
+	value      promql.Expr
+}
+
+// splitFieldConditions splits the field predicates joined by AND from the tag
+// predicates of the condition, the remaining tag condition is translated into
+// label matchers.
+func splitFieldConditions(cond influxql.Expr, getKeyType func(ref *influxql.VarRef) influxql.DataType) (influxql.Expr, []*fieldCondition, error) {
+	switch e := cond.(type) {
+	case *influxql.ParenExpr:
+		tagCond, fieldConds, err := splitFieldConditions(e.Expr, getKeyType)
+		if err != nil || tagCond == nil {
+			return nil, fieldConds, err
+		}
+		return &influxql.ParenExpr{Expr: tagCond}, fieldConds, nil
+	case *influxql.BinaryExpr:
+		switch e.Op {
+		case influxql.AND:
+			lhs, lhsConds, err := splitFieldConditions(e.LHS, getKeyType)
+			if err != nil {
+				return nil, nil, err
+			}
+			rhs, rhsConds, err := splitFieldConditions(e.RHS, getKeyType)
+			if err != nil {
+				return nil, nil, err
+			}
+			fieldConds := append(lhsConds, rhsConds...)
+			if lhs == nil {
+				return rhs, fieldConds, nil
+			}
+			if rhs == nil {
+				return lhs, fieldConds, nil
+			}
+			return &influxql.BinaryExpr{Op: influxql.AND, LHS: lhs, RHS: rhs}, fieldConds, nil
+		case influxql.OR:
+			var err error
+			influxql.WalkFunc(e, func(node influxql.Node) {
+				if be, ok := node.(*influxql.BinaryExpr); ok && err == nil {
+					if fc, _ := getFieldCondition(be, getKeyType); fc != nil {
+						err = errors.Errorf("field condition %s can't be joined by OR", be)
+					}
+				}
+			})
+			return cond, nil, err
+		default:
+			fieldCond, err := getFieldCondition(e, getKeyType)
+			if err != nil {
+				return nil, nil, err
+			}
+			if fieldCond != nil {
+				return nil, []*fieldCondition{fieldCond}, nil
+			}
+		}
+	}
+	return cond, nil, nil
+}
+
+// getFieldCondition returns the field predicate of the comparison, or nil when
+// it compares a tag. The keys unknown by getKeyType are guessed from the
+// literal, tags only hold strings, so comparisons to numbers and booleans are
+// field predicates.
+func getFieldCondition(expr *influxql.BinaryExpr, getKeyType func(ref *influxql.VarRef) influxql.DataType) (*fieldCondition, error) {
+	if !isComparisonOperator(expr.Op) {
+		return nil, nil
+	}
+	op, err := influxqlOpToPromqlOp(expr.Op)
+	if err != nil {
+		return nil, err
+	}
+	ref, ok := expr.LHS.(*influxql.VarRef)
+	literal := expr.RHS
+	if !ok {
+		if ref, ok = expr.RHS.(*influxql.VarRef); !ok {
+			return nil, nil
+		}
+		// 10 > usage_idle => usage_idle < 10
+		literal = expr.LHS
+		op = flipComparisonOperator(op)
+	}
+	keyType := getKeyType(ref)
+	if keyType == influxql.Tag {
+		return nil, nil
+	}
+
+	var value promql.Expr
+	switch v := literal.(type) {
+	case *influxql.IntegerLiteral, *influxql.NumberLiteral, *influxql.BooleanLiteral:
+		value, err = influxqlLiteralToPromqlExpr(v)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if isFieldType(keyType) {
+			return nil, errors.Errorf("condition %s on field %s is not supported", expr, ref.Val)
+		}
+		return nil, nil
+	}
+	return &fieldCondition{
+		field: ref.Val,
+		op:    op,
+		value: value,
+	}, nil
+}
+
+func isComparisonOperator(op influxql.Token) bool {
+	switch op {
+	case influxql.EQ, influxql.NEQ, influxql.LT, influxql.LTE, influxql.GT, influxql.GTE:
+		return true
+	}
+	return false
+}
+
+func flipComparisonOperator(op promql.ItemType) promql.ItemType {
+	switch op {
+	case promql.ItemLSS:
+		return promql.ItemGTR
+	case promql.ItemLTE:
+		return promql.ItemGTE
+	case promql.ItemGTR:
+		return promql.ItemLSS
+	case promql.ItemGTE:
+		return promql.ItemLTE
+	}
+	return op
+}
+
+// newFieldFilterExpr filters the points of the field series by the field
+// conditions. Conditions on the field itself are comparison filters, while
+// the conditions on other fields keep the points of the series with the same
+// tags whose other field matches, e.g.
+// cpu_usage_user > 0 and cpu_usage_idle < 10.
+func (m promQL) newFieldFilterExpr(metricName string, filters labelFilters, fieldConds []*fieldCondition) promql.Expr {
+	result := m.newVectorSelector(metricName, filters)
+	filter := func(expr promql.Expr, cond *fieldCondition) promql.Expr {
+		return &promql.BinaryExpr{
+			Op:  cond.op,
+			LHS: expr,
+			RHS: cond.value,
+		}
+	}
+	for _, cond := range fieldConds {
+		if cond.metricName == metricName {
+			result = filter(result, cond)
+		}
+	}
+	for _, cond := range fieldConds {
+		if cond.metricName == metricName {
+			continue
+		}
+		condName := cond.metricName
+		if !isValidMetricName(condName) {
+			condName = ""
+		}
+		condSeries := m.withGroupByOffset(newVectorSelector(condName, filters.withMetricName(cond.metricName)))
+		result = &promql.BinaryExpr{
+			Op:             promql.ItemLAND,
+			LHS:            result,
+			RHS:            filter(condSeries, cond),
+			VectorMatching: &promql.VectorMatching{Card: promql.CardManyToMany},
+		}
+	}
+	return result
+}
+
+// replaceMetricNameMatcher returns the label matchers selecting the metric name
+// instead of the metric name of ls.
+func replaceMetricNameMatcher(ls []*labels.Matcher, metricName string) []*labels.Matcher {
+	result := make([]*labels.Matcher, 0, len(ls)+1)
+	for _, l := range ls {
+		if l.Name != labels.MetricName {
+			result = append(result, l)
+		}
+	}
+	var nameMatcher *labels.Matcher
+	if isRegexMetricName(metricName) {
+		nameMatcher, _ = labels.NewMatcher(labels.MatchRegexp, labels.MetricName, trimRegexDelimiters(metricName))
+	} else {
+		nameMatcher, _ = labels.NewMatcher(labels.MatchEqual, labels.MetricName, metricName)
+	}
+	return append(result, nameMatcher)
+}
@@ -0,0 +1,124 @@
+package translator
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/influxdata/influxql"
+	"github.com/influxdata/promql/v2/pkg/labels"
+	"github.com/pkg/errors"
+)
+
+// DEFAULT_DATABASE_LABEL_NAME is the label holding the db query arg of the
+// Influx /write API in VictoriaMetrics.
+const DEFAULT_DATABASE_LABEL_NAME = "db"
+
+// RetentionPolicy describes where the series of a retention policy are stored.
+type RetentionPolicy struct {
+	// Labels select the series of the retention policy, e.g. vm_account_id="1"
+	// of the tenant
+	Labels map[string]string
+	// MetricPrefix is prepended to the metric names, e.g. downsampled_
+	MetricPrefix string
+}
+
+// RetentionPolicyMapping maps the retention policies of the databases.
+type RetentionPolicyMapping interface {
+	// GetRetentionPolicy returns the RetentionPolicy of the database, the
+	// retention policy is empty when the query doesn't give it. The series are
+	// selected as is when nil is returned.
+	GetRetentionPolicy(database string, retentionPolicy string) (*RetentionPolicy, error)
+}
+
+// RetentionPolicyMappingFunc is an adapter to use ordinary functions as RetentionPolicyMapping.
+type RetentionPolicyMappingFunc func(database string, retentionPolicy string) (*RetentionPolicy, error)
+
+func (f RetentionPolicyMappingFunc) GetRetentionPolicy(database string, retentionPolicy string) (*RetentionPolicy, error) {
+	return f(database, retentionPolicy)
+}
+
+// getDatabase returns the database and retention policy of the measurements,
+// the default database of the options is used when the query doesn't give it,
+// e.g. "telegraf"."autogen"."cpu" => telegraf, autogen.
+func (m promQL) getDatabase(sources influxql.Sources) (string, string, error) {
+	var database, retentionPolicy string
+	for i, src := range sources {
+		measurement, ok := src.(*influxql.Measurement)
+		if !ok {
+			continue
+		}
+		if i != 0 && (measurement.Database != database || measurement.RetentionPolicy != retentionPolicy) {
+			return "", "", errors.Errorf("measurements of different databases or retention policies can't be selected together: %s", sources)
+		}
+		database, retentionPolicy = measurement.Database, measurement.RetentionPolicy
+	}
+	if database == "" {
+		database = m.opts.database
+	}
+	return database, retentionPolicy, nil
+}
+
+// getRetentionPolicy returns the RetentionPolicy of the measurements mapped
+// by the options, or nil without mapping.
+func (m promQL) getRetentionPolicy(sources influxql.Sources) (*RetentionPolicy, error) {
+	if m.opts.retentionPolicyMapping == nil {
+		return nil, nil
+	}
+	database, retentionPolicy, err := m.getDatabase(sources)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := m.opts.retentionPolicyMapping.GetRetentionPolicy(database, retentionPolicy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "map retention policy %q of database %q", retentionPolicy, database)
+	}
+	return policy, nil
+}
+
+// getDatabaseMatchers returns the matchers selecting the series of the
+// database and retention policy, e.g. db="telegraf".
+func (m promQL) getDatabaseMatchers(sources influxql.Sources) ([]*labels.Matcher, error) {
+	database, _, err := m.getDatabase(sources)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*labels.Matcher, 0)
+	if database != "" && m.opts.databaseLabel != "" {
+		matcher, err := labels.NewMatcher(labels.MatchEqual, m.opts.databaseLabel, database)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, matcher)
+	}
+	if m.retentionPolicy == nil {
+		return result, nil
+	}
+	names := make([]string, 0, len(m.retentionPolicy.Labels))
+	for name := range m.retentionPolicy.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !isValidLabelName(name) {
+			return nil, errors.Errorf("invalid label name %q of retention policy", name)
+		}
+		matcher, err := labels.NewMatcher(labels.MatchEqual, name, m.retentionPolicy.Labels[name])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, matcher)
+	}
+	return result, nil
+}
+
+// getMetricPrefix returns the metric name prefix of the retention policy,
+// which is quoted for the regex metric names.
+func (m promQL) getMetricPrefix(isRegex bool) string {
+	if m.retentionPolicy == nil {
+		return ""
+	}
+	if isRegex {
+		return regexp.QuoteMeta(m.retentionPolicy.MetricPrefix)
+	}
+	return m.retentionPolicy.MetricPrefix
+}
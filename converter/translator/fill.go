@@ -0,0 +1,63 @@
+package translator
+
+import (
+	"github.com/influxdata/influxql"
+	"github.com/influxdata/promql/v2"
+	"github.com/pkg/errors"
+)
+
+// hasGroupByTime reports whether the statement groups the points by GROUP BY
+// time(), the fill() clause only applies to its buckets.
+func hasGroupByTime(s *influxql.SelectStatement) bool {
+	for _, d := range s.Dimensions {
+		if call, ok := d.Expr.(*influxql.Call); ok && call.Name == "time" {
+			return true
+		}
+	}
+	return false
+}
+
+// fillExpr fills the empty GROUP BY time() buckets of the field expression
+// like the fill() clause, e.g. fill(0) => q default 0, fill(previous) =>
+// keep_last_value(q) and fill(linear) => interpolate(q). The empty buckets of
+// fill(null) and fill(none) are left as gaps.
+func (m *promQL) fillExpr(s *influxql.SelectStatement, expr promql.Expr) (promql.Expr, error) {
+	if !hasGroupByTime(s) {
+		return expr, nil
+	}
+	m.metadata.Fill = s.Fill
+	switch s.Fill {
+	case influxql.NullFill, influxql.NoFill:
+		return expr, nil
+	case influxql.NumberFill:
+		value, err := getFillValue(s.FillValue)
+		if err != nil {
+			return nil, err
+		}
+		m.metadata.FillValue = value
+		// https://docs.victoriametrics.com/MetricsQL.html#default
+		return newBinaryOpExpr("default", &promql.BinaryExpr{
+			LHS: expr,
+			RHS: &promql.NumberLiteral{Val: value},
+		}), nil
+	case influxql.PreviousFill:
+		// https://docs.victoriametrics.com/MetricsQL.html#keep_last_value
+		return newAggrExpr("keep_last_value", promql.ValueTypeVector, promql.ValueTypeVector, expr), nil
+	case influxql.LinearFill:
+		// https://docs.victoriametrics.com/MetricsQL.html#interpolate
+		return newAggrExpr("interpolate", promql.ValueTypeVector, promql.ValueTypeVector, expr), nil
+	}
+	return nil, errors.Errorf("not supported fill option %d", s.Fill)
+}
+
+func getFillValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	}
+	return 0, errors.Errorf("not supported fill value %v", value)
+}
@@ -0,0 +1,86 @@
+package translator
+
+import (
+	"github.com/influxdata/promql/v2"
+)
+
+const (
+	CALL_ABS   = "abs"
+	CALL_LOG   = "log"
+	CALL_POW   = "pow"
+	CALL_ATAN2 = "atan2"
+)
+
+// MATH_FUNCTIONS are the InfluxQL math functions applied to each point,
+// https://docs.influxdata.com/influxdb/v1/query_language/functions/#transformations
+var MATH_FUNCTIONS Functions = []string{
+	CALL_ABS, "ceil", "floor", "round", "sqrt",
+	"ln", CALL_LOG, "log2", "log10", "exp", CALL_POW,
+	"sin", "cos", "tan", "asin", "acos", "atan",
+}
+
+func newMathExpr(op *AggrOperator, expr promql.Expr, keepMetricNames bool) promql.Expr {
+	switch op.Name {
+	case CALL_POW:
+		// MetricsQL has no pow function, the ^ operator drops the metric names
+		// even of the raw points, which are only told apart by their labels. The
+		// results are still labelled by label_set in the union of fields.
+		return &promql.BinaryExpr{
+			Op:  promql.ItemPOW,
+			LHS: parenIfBinaryExpr(expr),
+			RHS: op.Args[0],
+		}
+	case CALL_LOG:
+		// log(x, b) = ln(x) / ln(b)
+		switch op.Args[0].String() {
+		case "2":
+			return newMathCall("log2", expr, keepMetricNames)
+		case "10":
+			return newMathCall("log10", expr, keepMetricNames)
+		}
+		return &promql.BinaryExpr{
+			Op:  promql.ItemDIV,
+			LHS: newMathCall("ln", expr, keepMetricNames),
+			RHS: newMathCall("ln", op.Args[0], false),
+		}
+	}
+	return newMathCall(op.Name, expr, keepMetricNames)
+}
+
+func newMathCall(name string, expr promql.Expr, keepMetricNames bool) promql.Expr {
+	call := newAggrExpr(name, promql.ValueTypeVector, promql.ValueTypeVector, expr).(*promql.Call)
+	if keepMetricNames {
+		return newKeepMetricNamesExpr(call)
+	}
+	return call
+}
+
+// newAtan2Expr translates atan2(y, x) to the MetricsQL atan2 binary operator.
+func newAtan2Expr(lhs, rhs promql.Expr) promql.Expr {
+	binExpr := &promql.BinaryExpr{
+		LHS: parenIfBinaryExpr(lhs),
+		RHS: parenIfBinaryExpr(rhs),
+	}
+	if lhs.Type() != promql.ValueTypeScalar && rhs.Type() != promql.ValueTypeScalar {
+		binExpr.VectorMatching = getVectorMatching(lhs)
+	}
+	return newBinaryOpExpr(CALL_ATAN2, binExpr)
+}
+
+func parenIfBinaryExpr(expr promql.Expr) promql.Expr {
+	switch expr.(type) {
+	case *promql.BinaryExpr, *binaryOpExpr:
+		return &promql.ParenExpr{Expr: expr}
+	}
+	return expr
+}
+
+// parenIfBinaryOpExpr keeps the precedence of the MetricsQL binary operators
+// used as operands, e.g. 2 / (y atan2 x), whose nested operands are already
+// grouped by the InfluxQL AST.
+func parenIfBinaryOpExpr(expr promql.Expr) promql.Expr {
+	if _, ok := expr.(*binaryOpExpr); ok {
+		return &promql.ParenExpr{Expr: expr}
+	}
+	return expr
+}
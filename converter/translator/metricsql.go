@@ -0,0 +1,186 @@
+package translator
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/influxdata/promql/v2"
+	"github.com/influxdata/promql/v2/pkg/labels"
+	"github.com/prometheus/common/model"
+)
+
+// keepMetricNamesExpr appends the MetricsQL keep_metric_names modifier to a
+// function call, so the metric names are kept in the results:
+// https://docs.victoriametrics.com/MetricsQL.html#keep_metric_names
+type keepMetricNamesExpr struct {
+	*promql.Call
+}
+
+func newKeepMetricNamesExpr(call *promql.Call) promql.Expr {
+	return &keepMetricNamesExpr{Call: call}
+}
+
+func (e *keepMetricNamesExpr) String() string {
+	return fmt.Sprintf("%s keep_metric_names", e.Call)
+}
+
+// binaryOpExpr is a MetricsQL binary operator unknown to the PromQL AST,
+// e.g. atan2: https://docs.victoriametrics.com/MetricsQL.html#atan2
+type binaryOpExpr struct {
+	*promql.BinaryExpr
+	op string
+}
+
+func newBinaryOpExpr(op string, expr *promql.BinaryExpr) promql.Expr {
+	return &binaryOpExpr{BinaryExpr: expr, op: op}
+}
+
+func (e *binaryOpExpr) String() string {
+	matching := ""
+	vm := e.VectorMatching
+	if vm != nil && (len(vm.MatchingLabels) > 0 || vm.On) {
+		if vm.On {
+			matching = fmt.Sprintf(" on(%s)", strings.Join(vm.MatchingLabels, ", "))
+		} else {
+			matching = fmt.Sprintf(" ignoring(%s)", strings.Join(vm.MatchingLabels, ", "))
+		}
+	}
+	return fmt.Sprintf("%s %s%s %s", e.LHS, e.op, matching, e.RHS)
+}
+
+// aggrFuncExpr is a MetricsQL aggregate function unknown to the PromQL AST,
+// e.g. mode: https://docs.victoriametrics.com/MetricsQL.html#mode
+type aggrFuncExpr struct {
+	*promql.AggregateExpr
+	name string
+}
+
+func newAggrFuncExpr(name string, expr *promql.AggregateExpr) promql.Expr {
+	return &aggrFuncExpr{AggregateExpr: expr, name: name}
+}
+
+func (e *aggrFuncExpr) String() string {
+	grouping := ""
+	if len(e.Grouping) != 0 {
+		grouping = fmt.Sprintf(" by(%s) ", strings.Join(e.Grouping, ", "))
+	}
+	return fmt.Sprintf("%s%s(%s)", e.name, grouping, e.Expr)
+}
+
+// groupedCallExpr appends the MetricsQL by modifier to a function call, e.g.
+// topk_avg(3, x) by(host): https://docs.victoriametrics.com/MetricsQL.html#topk_avg
+type groupedCallExpr struct {
+	*promql.Call
+	Grouping []string
+}
+
+func newGroupedCallExpr(call *promql.Call, grouping []string) promql.Expr {
+	return &groupedCallExpr{Call: call, Grouping: grouping}
+}
+
+func (e *groupedCallExpr) String() string {
+	return fmt.Sprintf("%s by(%s)", e.Call, strings.Join(e.Grouping, ", "))
+}
+
+// orVectorSelector selects the series matching any group of the label filters
+// by the MetricsQL or filters, e.g. disk_free{host="a",path="/" or host="b"}:
+// https://docs.victoriametrics.com/keyConcepts.html#filtering-by-multiple-or-filters
+type orVectorSelector struct {
+	*promql.VectorSelector
+	filters labelFilters
+}
+
+// newVectorSelector returns the selector of the series matching the filters,
+// the or filters are only used by multiple groups of matchers.
+func newVectorSelector(name string, filters labelFilters) promql.Expr {
+	vs := &promql.VectorSelector{
+		Name:          name,
+		LabelMatchers: filters[0],
+	}
+	if len(filters) == 1 {
+		return vs
+	}
+	return &orVectorSelector{VectorSelector: vs, filters: filters}
+}
+
+func (e *orVectorSelector) String() string {
+	return formatOrSelector(e.Name, e.filters, "", e.Offset)
+}
+
+// orMatrixSelector is the range vector of orVectorSelector.
+type orMatrixSelector struct {
+	*promql.MatrixSelector
+	filters labelFilters
+}
+
+func newMatrixSelector(name string, filters labelFilters, window time.Duration) promql.Expr {
+	ms := &promql.MatrixSelector{
+		Name:          name,
+		LabelMatchers: filters[0],
+		Range:         window,
+	}
+	if len(filters) == 1 {
+		return ms
+	}
+	return &orMatrixSelector{MatrixSelector: ms, filters: filters}
+}
+
+func (e *orMatrixSelector) String() string {
+	return formatOrSelector(e.Name, e.filters, fmt.Sprintf("[%s]", model.Duration(e.Range)), e.Offset)
+}
+
+func formatOrSelector(name string, filters labelFilters, window string, offset time.Duration) string {
+	groups := make([]string, len(filters))
+	for i, ls := range filters {
+		matchers := make([]string, 0, len(ls))
+		for _, l := range ls {
+			// the metric name is already given by the selector
+			if l.Name == labels.MetricName && l.Type == labels.MatchEqual && l.Value == name {
+				continue
+			}
+			matchers = append(matchers, l.String())
+		}
+		groups[i] = strings.Join(matchers, ",")
+	}
+	offsetStr := ""
+	if offset != 0 {
+		offsetStr = fmt.Sprintf(" offset %s", model.Duration(offset))
+	}
+	return fmt.Sprintf("%s{%s}%s%s", name, strings.Join(groups, " or "), window, offsetStr)
+}
+
+// toMatrixSelector returns the range vector of the series selector.
+func toMatrixSelector(expr promql.Expr, window time.Duration) (promql.Expr, bool) {
+	switch e := expr.(type) {
+	case *promql.VectorSelector:
+		return withOffset(newMatrixSelector(e.Name, labelFilters{e.LabelMatchers}, window), e.Offset)
+	case *orVectorSelector:
+		return withOffset(newMatrixSelector(e.Name, e.filters, window), e.Offset)
+	}
+	return nil, false
+}
+
+// withOffset returns a copy of the series selector shifted back by offset
+// further, a negative offset shifts it forward.
+func withOffset(expr promql.Expr, offset time.Duration) (promql.Expr, bool) {
+	switch e := expr.(type) {
+	case *promql.VectorSelector:
+		vs := *e
+		vs.Offset += offset
+		return &vs, true
+	case *orVectorSelector:
+		vs := *e.VectorSelector
+		vs.Offset += offset
+		return &orVectorSelector{VectorSelector: &vs, filters: e.filters}, true
+	case *promql.MatrixSelector:
+		ms := *e
+		ms.Offset += offset
+		return &ms, true
+	case *orMatrixSelector:
+		ms := *e.MatrixSelector
+		ms.Offset += offset
+		return &orMatrixSelector{MatrixSelector: &ms, filters: e.filters}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,65 @@
+package translator
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// unsupportedMetricNameChars are replaced with underscores by the
+	// -usePromCompatibleNaming ingestion of VictoriaMetrics
+	unsupportedMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	// unsupportedLabelNameChars are replaced with underscores by the
+	// -usePromCompatibleNaming ingestion of VictoriaMetrics
+	unsupportedLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	validMetricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	validLabelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+func isValidMetricName(name string) bool {
+	return validMetricNamePattern.MatchString(name)
+}
+
+func isValidLabelName(name string) bool {
+	return validLabelNamePattern.MatchString(name)
+}
+
+// sanitizeMetricName replaces the chars the ingestion doesn't store in metric names.
+func (m promQL) sanitizeMetricName(name string) string {
+	if m.opts.nameSanitizing != NAME_SANITIZING_PROMETHEUS {
+		return name
+	}
+	result := unsupportedMetricNameChars.ReplaceAllString(name, "_")
+	m.metadata.addNameMapping(name, result)
+	return result
+}
+
+// sanitizeLabelName returns the label name of a tag key, escaping the chars left invalid.
+func (m promQL) sanitizeLabelName(name string) string {
+	result := name
+	if m.opts.nameSanitizing == NAME_SANITIZING_PROMETHEUS {
+		result = unsupportedLabelNameChars.ReplaceAllString(result, "_")
+	}
+	if !isValidLabelName(result) {
+		result = escapeLabelName(result)
+	}
+	m.metadata.addNameMapping(name, result)
+	return result
+}
+
+// escapeLabelName escapes the chars unsupported by the label names of MetricsQL:
+// https://docs.victoriametrics.com/MetricsQL.html#metricsql-features
+func escapeLabelName(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case '0' <= r && r <= '9' && i != 0:
+		default:
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
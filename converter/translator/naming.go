@@ -0,0 +1,122 @@
+package translator
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/influxdata/influxql"
+	"github.com/influxdata/promql/v2/pkg/labels"
+)
+
+// NamingStrategy decides the metric names of the InfluxDB fields, it should
+// match how the line protocol is ingested.
+type NamingStrategy interface {
+	// GetMetricName returns the metric name of the measurement field, the
+	// measurement and field are regex patterns when isRegex is true.
+	GetMetricName(measurement string, field string, isRegex bool) string
+	// HasMeasurementInName reports whether the measurement is a part of the metric names.
+	HasMeasurementInName() bool
+	// GetMeasurementLabel returns the label holding the measurement when it
+	// isn't a part of the metric names, the measurement is dropped when empty.
+	GetMeasurementLabel() string
+}
+
+// DEFAULT_MEASUREMENT_FIELD_SEPARATOR is the default -influxMeasurementFieldSeparator of VictoriaMetrics
+const DEFAULT_MEASUREMENT_FIELD_SEPARATOR = "_"
+
+// InfluxNaming is the NamingStrategy of the Influx line protocol ingestion of
+// VictoriaMetrics, https://docs.victoriametrics.com/#how-to-send-data-from-influxdb-compatible-agents-such-as-telegraf.
+// The Telegraf Prometheus output is matched by SingleFieldName "value".
+type InfluxNaming struct {
+	// Separator joins the measurement and field like -influxMeasurementFieldSeparator
+	Separator string
+	// SingleFieldName is the field named by the measurement only like
+	// -influxSkipSingleField, e.g. value
+	SingleFieldName string
+	// SkipMeasurement names the metrics by the fields only like -influxSkipMeasurement
+	SkipMeasurement bool
+	// MeasurementLabel is the label holding the measurement instead of the metric
+	// names, e.g. measurement
+	MeasurementLabel string
+}
+
+// NewInfluxNaming returns the InfluxNaming of the default ingestion, whose
+// metric names are measurement_field.
+func NewInfluxNaming() *InfluxNaming {
+	return &InfluxNaming{
+		Separator: DEFAULT_MEASUREMENT_FIELD_SEPARATOR,
+	}
+}
+
+func (n *InfluxNaming) GetMetricName(measurement string, field string, isRegex bool) string {
+	if !n.HasMeasurementInName() {
+		return field
+	}
+	sep := n.Separator
+	if isRegex {
+		sep = regexp.QuoteMeta(sep)
+	}
+	if n.SingleFieldName != "" {
+		if !isRegex && field == n.SingleFieldName {
+			return measurement
+		}
+		if isRegex && matchRegexFully(field, n.SingleFieldName) {
+			// the single field is only named by the measurement
+			return fmt.Sprintf("%s(?:%s%s)?", measurement, sep, field)
+		}
+	}
+	return measurement + sep + field
+}
+
+func (n *InfluxNaming) HasMeasurementInName() bool {
+	return !n.SkipMeasurement && n.MeasurementLabel == ""
+}
+
+func (n *InfluxNaming) GetMeasurementLabel() string {
+	return n.MeasurementLabel
+}
+
+// matchRegexFully reports whether the regex pattern matches the whole value like PromQL matchers.
+func matchRegexFully(pattern string, value string) bool {
+	re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern))
+	return err == nil && re.MatchString(value)
+}
+
+// getMeasurementLabelName returns the label telling the series of multiple or
+// regex measurements apart.
+func (m promQL) getMeasurementLabelName() string {
+	if label := m.opts.naming.GetMeasurementLabel(); label != "" {
+		return label
+	}
+	return MEASUREMENT_LABEL_NAME
+}
+
+// getMeasurementMatcher returns the matcher of the measurement label, e.g.
+// measurement=~"(net_eth0|net_eth1)".
+func getMeasurementMatcher(sources influxql.Sources, label string) (*labels.Matcher, error) {
+	measurement, isRegex, err := getMeasurement(sources, nil)
+	if err != nil {
+		return nil, err
+	}
+	if isRegex {
+		return labels.NewMatcher(labels.MatchRegexp, label, measurement)
+	}
+	return labels.NewMatcher(labels.MatchEqual, label, measurement)
+}
+
+// checkMeasurementNaming warns when the measurements can't be selected because
+// the naming strategy drops them.
+func (m promQL) checkMeasurementNaming(sources influxql.Sources) {
+	naming := m.opts.naming
+	if naming.HasMeasurementInName() || naming.GetMeasurementLabel() != "" {
+		return
+	}
+	for {
+		subQuery, ok := getSubQuerySource(sources)
+		if !ok {
+			break
+		}
+		sources = subQuery.Statement.Sources
+	}
+	m.metadata.addWarning("measurement %s isn't kept by the naming strategy, the same fields of other measurements are selected too", sources)
+}
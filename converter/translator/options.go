@@ -0,0 +1,142 @@
+package translator
+
+import (
+	"github.com/pkg/errors"
+)
+
+// TopkFlavour decides how top() and bottom() rank the series over the time range,
+// https://docs.victoriametrics.com/MetricsQL.html#topk_avg
+type TopkFlavour string
+
+const (
+	// TOPK_FLAVOUR_NONE ranks the series at each point by plain topk and bottomk
+	TOPK_FLAVOUR_NONE TopkFlavour = ""
+	TOPK_FLAVOUR_MAX  TopkFlavour = "max"
+	TOPK_FLAVOUR_AVG  TopkFlavour = "avg"
+	TOPK_FLAVOUR_LAST TopkFlavour = "last"
+)
+
+// getFuncName returns the MetricsQL function name of the flavour, e.g. topk_avg.
+func (f TopkFlavour) getFuncName(name string) string {
+	if f == TOPK_FLAVOUR_NONE {
+		return name
+	}
+	return name + "_" + string(f)
+}
+
+// NameSanitizing decides how the names unsupported by Prometheus are
+// translated, it should match the Influx ingestion of VictoriaMetrics.
+type NameSanitizing string
+
+const (
+	// NAME_SANITIZING_NONE keeps the names like the default ingestion, the
+	// invalid metric names are selected by {__name__="..."} and the invalid
+	// label names are escaped
+	NAME_SANITIZING_NONE NameSanitizing = "none"
+	// NAME_SANITIZING_PROMETHEUS replaces the unsupported chars with underscores
+	// like the ingestion with -usePromCompatibleNaming
+	NAME_SANITIZING_PROMETHEUS NameSanitizing = "prometheus"
+)
+
+type options struct {
+	topkFlavour            TopkFlavour
+	schema                 Schema
+	nameSanitizing         NameSanitizing
+	naming                 NamingStrategy
+	database               string
+	databaseLabel          string
+	retentionPolicyMapping RetentionPolicyMapping
+}
+
+func newOptions(opts ...Option) options {
+	o := options{
+		topkFlavour:    TOPK_FLAVOUR_AVG,
+		nameSanitizing: NAME_SANITIZING_NONE,
+		naming:         NewInfluxNaming(),
+		databaseLabel:  DEFAULT_DATABASE_LABEL_NAME,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func (o options) validate() error {
+	switch o.topkFlavour {
+	case TOPK_FLAVOUR_NONE, TOPK_FLAVOUR_MAX, TOPK_FLAVOUR_AVG, TOPK_FLAVOUR_LAST:
+	default:
+		return errors.Errorf("unknown topk flavour %q", o.topkFlavour)
+	}
+	switch o.nameSanitizing {
+	case NAME_SANITIZING_NONE, NAME_SANITIZING_PROMETHEUS:
+	default:
+		return errors.Errorf("unknown name sanitizing %q", o.nameSanitizing)
+	}
+	if o.naming == nil {
+		return errors.Errorf("naming strategy is nil")
+	}
+	if o.databaseLabel != "" && !isValidLabelName(o.databaseLabel) {
+		return errors.Errorf("invalid database label name %q", o.databaseLabel)
+	}
+	return nil
+}
+
+// Option customizes the translation of the Translator.
+type Option func(o *options)
+
+// WithTopkFlavour sets the flavour of topk and bottomk translated from top() and bottom(),
+// TOPK_FLAVOUR_AVG is used by default.
+func WithTopkFlavour(flavour TopkFlavour) Option {
+	return func(o *options) {
+		o.topkFlavour = flavour
+	}
+}
+
+// WithSchema sets the Schema telling the tags from the fields, the keys
+// unknown by the schema are guessed from the query.
+func WithSchema(schema Schema) Option {
+	return func(o *options) {
+		o.schema = schema
+	}
+}
+
+// WithNameSanitizing sets how the names unsupported by Prometheus are translated,
+// NAME_SANITIZING_NONE is used by default.
+func WithNameSanitizing(sanitizing NameSanitizing) Option {
+	return func(o *options) {
+		o.nameSanitizing = sanitizing
+	}
+}
+
+// WithNamingStrategy sets how the measurements and fields are named in the
+// metrics, NewInfluxNaming() is used by default.
+func WithNamingStrategy(naming NamingStrategy) Option {
+	return func(o *options) {
+		o.naming = naming
+	}
+}
+
+// WithDatabase sets the database of the measurements which don't give it,
+// like the db query arg of the InfluxDB /query API.
+func WithDatabase(database string) Option {
+	return func(o *options) {
+		o.database = database
+	}
+}
+
+// WithDatabaseLabel sets the label holding the database of the series,
+// DEFAULT_DATABASE_LABEL_NAME is used by default. The database isn't matched
+// when the label is empty.
+func WithDatabaseLabel(label string) Option {
+	return func(o *options) {
+		o.databaseLabel = label
+	}
+}
+
+// WithRetentionPolicyMapping sets how the retention policies are mapped to the
+// series, the retention policies are ignored by default.
+func WithRetentionPolicyMapping(mapping RetentionPolicyMapping) Option {
+	return func(o *options) {
+		o.retentionPolicyMapping = mapping
+	}
+}
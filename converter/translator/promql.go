@@ -2,7 +2,7 @@ package translator
 
 import (
 	"fmt"
-	"log"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +16,14 @@ import (
 
 const UNION_RESULT_NAME = "__union_result__"
 
+// MEASUREMENT_LABEL_NAME is the label exposing the measurement of series
+// selected from multiple or regex measurements.
+const MEASUREMENT_LABEL_NAME = "__measurement__"
+
+// DISTINCT_VALUE_LABEL_NAME is the label holding the distinct values of
+// series counted by count_values_over_time.
+const DISTINCT_VALUE_LABEL_NAME = "__distinct_value__"
+
 const (
 	CALL_TOP        = "top"
 	CALL_BOTTOM     = "bottom"
@@ -23,9 +31,23 @@ const (
 	CALL_SUM        = "sum"
 	CALL_MIN        = "min"
 	CALL_MAX        = "max"
+	CALL_COUNT      = "count"
+	CALL_MEAN       = "mean"
+	CALL_FIRST      = "first"
+	CALL_LAST       = "last"
+	CALL_SPREAD     = "spread"
+	CALL_SAMPLE     = "sample"
+	CALL_INTEGRAL   = "integral"
+	CALL_DISTINCT   = "distinct"
+	CALL_MEDIAN     = "median"
+	CALL_MODE       = "mode"
+	CALL_STDDEV     = "stddev"
 )
 
-var MUL_ARGS_AGGREGATOR MulArgsAggregator = []string{CALL_TOP, CALL_PERCENTILE, CALL_BOTTOM}
+var MUL_ARGS_AGGREGATOR MulArgsAggregator = []string{CALL_TOP, CALL_PERCENTILE, CALL_BOTTOM, CALL_ATAN2}
+
+// DURATION_UNIT_FUNCTIONS take a duration unit argument, e.g. integral(x, 1h).
+var DURATION_UNIT_FUNCTIONS Functions = []string{CALL_ELAPSED, CALL_DERIVATIVE, CALL_NON_NEGATIVE_DERIVATIVE, CALL_INTEGRAL}
 
 type MulArgsAggregator []string
 
@@ -43,13 +65,27 @@ type promQL struct {
 	timeRange       *influxql.TimeRange
 	fieldIsWildcard bool
 	fieldIsRegex    bool
-	measurement     string
-	labelsVisitor   *labelsVisitor
+	// fieldVariableIsRegex is true when the fields are selected by regex, e.g. last(/^usage/)
+	fieldVariableIsRegex bool
+	measurement          string
+	// measurementIsRegex is true when selecting from multiple or regex measurements
+	measurementIsRegex bool
+	metadata           *Metadata
+	// forecast is the duration the time range is extended by holt_winters
+	forecast time.Duration
+	opts     options
+	// sources are the sources of the statement being translated
+	sources influxql.Sources
+	// retentionPolicy is the mapped retention policy of the sources
+	retentionPolicy *RetentionPolicy
+	// groupByOffset is the offset of the GROUP BY time() buckets
+	groupByOffset time.Duration
 }
 
-func NewPromQL() Translator {
+func NewPromQL(opts ...Option) Translator {
 	return &promQL{
-		labelsVisitor: newLabelsVisitor(),
+		metadata: newMetadata(),
+		opts:     newOptions(opts...),
 	}
 }
 
@@ -58,6 +94,14 @@ func (m *promQL) Translate(s influxql.Statement) (string, error) {
 	if !ok {
 		return "", errors.Errorf("Only SelectStatement is supported, input %t", s)
 	}
+	if err := m.opts.validate(); err != nil {
+		return "", errors.Wrap(err, "validate options")
+	}
+	// the state of the previous statement is reset
+	*m = promQL{
+		metadata: newMetadata(),
+		opts:     m.opts,
+	}
 	return m.translate(selectS)
 }
 
@@ -65,22 +109,88 @@ func (m *promQL) GetTimeRange() *influxql.TimeRange {
 	return m.timeRange
 }
 
+func (m *promQL) GetMetadata() *Metadata {
+	return m.metadata
+}
+
 type fieldResult struct {
 	metricName string
-	aggrOps    []*AggrOperator
-	expr       promql.Expr
+	// name labels the results in the union of fields, which is the metric
+	// name unless the metric names are matched by regex
+	name string
+	// alias labels the results in the union instead of the name and operators
+	// when the field is selected AS alias
+	alias   string
+	aggrOps []*AggrOperator
+	expr    promql.Expr
 }
 
 func newFieldResult(metricName string, ops []*AggrOperator, expr promql.Expr) *fieldResult {
 	return &fieldResult{
 		metricName: metricName,
+		name:       metricName,
 		aggrOps:    ops,
 		expr:       expr,
 	}
 }
 
+// withName sets the name of the results matched by regex metric names, which
+// is made of the measurement and field names of the query instead of the translated
+// regex, e.g. net_eth0_net_eth1_bytes for SELECT bytes FROM net_eth0, net_eth1,
+// the regexes are named without their delimiters like trimRegexDelimiters.
+func (r *fieldResult) withName(sources influxql.Sources, field *influxql.Field) *fieldResult {
+	if !isRegexMetricName(r.metricName) {
+		return r
+	}
+	names := make([]string, 0, len(sources)+1)
+	for _, src := range sources {
+		if measurement, ok := src.(*influxql.Measurement); ok {
+			if measurement.Regex != nil {
+				names = append(names, measurement.Regex.Val.String())
+			} else {
+				names = append(names, measurement.Name)
+			}
+		}
+	}
+	fieldName := ""
+	influxql.WalkFunc(field.Expr, func(node influxql.Node) {
+		if fieldName != "" {
+			return
+		}
+		switch n := node.(type) {
+		case *influxql.VarRef:
+			fieldName = n.Val
+		case *influxql.RegexLiteral:
+			fieldName = n.Val.String()
+		}
+	})
+	r.name = strings.Join(append(names, fieldName), "_")
+	return r
+}
+
 func (m *promQL) translateField(s *influxql.SelectStatement, field *influxql.Field) (*fieldResult, error) {
-	metricName, err := getMetricName(s.Sources, field)
+	m.sources = s.Sources
+	if _, ok := getSubQuerySource(s.Sources); !ok {
+		retentionPolicy, err := m.getRetentionPolicy(s.Sources)
+		if err != nil {
+			return nil, errors.Wrap(err, "get retention policy")
+		}
+		m.retentionPolicy = retentionPolicy
+	}
+	if isArithmeticField(field.Expr) {
+		return m.translateArithmeticField(s, field)
+	}
+	if subQuery, ok := getSubQuerySource(s.Sources); ok {
+		return m.translateSubQueryField(s, subQuery, field)
+	}
+
+	_, measurementIsRegex, err := getMeasurement(s.Sources, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "getMeasurement")
+	}
+	// the measurements are only told apart when they are kept in the series
+	m.measurementIsRegex = measurementIsRegex && (m.opts.naming.HasMeasurementInName() || m.opts.naming.GetMeasurementLabel() != "")
+	metricName, err := m.getMetricName(s.Sources, field)
 	if err != nil {
 		if errors.Cause(err) == ErrVariableIsWildcard {
 			m.measurement = metricName
@@ -99,21 +209,49 @@ func (m *promQL) translateField(s *influxql.SelectStatement, field *influxql.Fie
 		return nil, errors.Wrap(err, "getTimeRange")
 	}
 	m.timeRange = timeRange
+	cond, fieldConds, err := splitFieldConditions(cond, m.getKeyType)
+	if err != nil {
+		return nil, errors.Wrap(err, "split field conditions")
+	}
+	for _, fieldCond := range fieldConds {
+		fieldCond.metricName, err = m.getMetricName(s.Sources, &influxql.Field{Expr: &influxql.VarRef{Val: fieldCond.field}})
+		if err != nil {
+			return nil, errors.Wrapf(err, "get metric name of condition field %s", fieldCond.field)
+		}
+	}
 
-	matchers, err := m.getLabels(m.labelsVisitor, cond)
+	filters, err := m.getLabelFilters(cond)
 	if err != nil {
 		return nil, errors.Wrap(err, "get matchers")
 	}
+	if label := m.opts.naming.GetMeasurementLabel(); label != "" {
+		measurementMatcher, err := getMeasurementMatcher(s.Sources, label)
+		if err != nil {
+			return nil, errors.Wrap(err, "get measurement matcher")
+		}
+		filters = filters.withMatcher(measurementMatcher)
+	}
+	databaseMatchers, err := m.getDatabaseMatchers(s.Sources)
+	if err != nil {
+		return nil, errors.Wrap(err, "get database matchers")
+	}
+	for _, matcher := range databaseMatchers {
+		filters = filters.withMatcher(matcher)
+	}
 	m.fieldIsRegex = false
+	m.fieldVariableIsRegex = false
+	if fieldName, err := getFieldVariable(field); err == nil {
+		m.fieldVariableIsRegex = isRegexMetricName(fieldName)
+	}
 	if !m.fieldIsWildcard {
 		if isRegexMetricName(metricName) {
 			m.fieldIsRegex = true
 			regexPattern := trimRegexDelimiters(metricName)
 			nameMatcher, _ := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, regexPattern)
-			matchers = append(matchers, nameMatcher)
+			filters = filters.withMatcher(nameMatcher)
 		} else {
 			nameMatcher, _ := labels.NewMatcher(labels.MatchEqual, labels.MetricName, metricName)
-			matchers = append(matchers, nameMatcher)
+			filters = filters.withMatcher(nameMatcher)
 		}
 	}
 
@@ -127,30 +265,307 @@ func (m *promQL) translateField(s *influxql.SelectStatement, field *influxql.Fie
 	//}
 	//fmt.Printf("==get interval: %#v\n", interval)
 
-	expr, err := m.generateExpr(metricName, matchers, lookbehindWin, aggrOps, groups)
+	expr, err := m.generateExpr(metricName, filters, fieldConds, lookbehindWin, aggrOps, groups)
 	if err != nil {
 		return nil, errors.Wrap(err, "generate expression")
 	}
-	if binExpr, ok := field.Expr.(*influxql.BinaryExpr); ok {
-		expr, err = wrapBinaryExpr(binExpr, expr)
+	return newFieldResult(metricName, aggrOps, expr).withName(s.Sources, field), nil
+}
+
+// isArithmeticField reports whether the field expression is arithmetic between
+// fields, aggregates or literals, e.g. used / total * 100 or mean(used) / mean(total).
+func isArithmeticField(expr influxql.Expr) bool {
+	switch e := expr.(type) {
+	case *influxql.BinaryExpr, *influxql.ParenExpr:
+		return true
+	case *influxql.Call:
+		return e.Name == CALL_ATAN2
+	}
+	return false
+}
+
+// translateArithmeticField translates each operand of the field expression to
+// its own series expression and combines them with PromQL binary operators.
+func (m *promQL) translateArithmeticField(s *influxql.SelectStatement, field *influxql.Field) (*fieldResult, error) {
+	// the operands of subquery fields are looked up by translateSubQueryField,
+	// the result is named like the InfluxDB column, e.g. m_n of m / n
+	metricName := field.Name()
+	if _, ok := getSubQuerySource(s.Sources); !ok {
+		var err error
+		metricName, err = m.getMetricName(s.Sources, field)
 		if err != nil {
-			return nil, errors.Wrap(err, "wrap binary expression")
+			return nil, errors.Wrap(err, "getMetricName")
 		}
 	}
-	return newFieldResult(metricName, aggrOps, expr), nil
+	expr, err := m.translateOperand(s, field.Expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "translate expression %s", field.Expr)
+	}
+	return newFieldResult(metricName, nil, expr).withName(s.Sources, field), nil
+}
+
+func (m *promQL) translateOperand(s *influxql.SelectStatement, expr influxql.Expr) (promql.Expr, error) {
+	switch e := expr.(type) {
+	case *influxql.BinaryExpr:
+		op, err := influxqlOpToPromqlOp(e.Op)
+		if err != nil {
+			return nil, err
+		}
+		lhs, err := m.translateOperand(s, e.LHS)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := m.translateOperand(s, e.RHS)
+		if err != nil {
+			return nil, err
+		}
+		binExpr := &promql.BinaryExpr{
+			Op:  op,
+			LHS: parenIfBinaryOpExpr(lhs),
+			RHS: parenIfBinaryOpExpr(rhs),
+		}
+		if lhs.Type() != promql.ValueTypeScalar && rhs.Type() != promql.ValueTypeScalar {
+			binExpr.VectorMatching = getVectorMatching(lhs)
+		}
+		return binExpr, nil
+	case *influxql.ParenExpr:
+		inner, err := m.translateOperand(s, e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &promql.ParenExpr{Expr: inner}, nil
+	case *influxql.IntegerLiteral, *influxql.NumberLiteral:
+		return influxqlLiteralToPromqlExpr(e)
+	case *influxql.Call:
+		if e.Name != CALL_ATAN2 {
+			return m.translateFieldOperand(s, e)
+		}
+		if len(e.Args) != 2 {
+			return nil, errors.Errorf("%s requires 2 arguments: %s", e.Name, e)
+		}
+		lhs, err := m.translateOperand(s, e.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := m.translateOperand(s, e.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return newAtan2Expr(lhs, rhs), nil
+	default:
+		return m.translateFieldOperand(s, e)
+	}
+}
+
+func (m *promQL) translateFieldOperand(s *influxql.SelectStatement, expr influxql.Expr) (promql.Expr, error) {
+	result, err := m.translateField(s, &influxql.Field{Expr: expr})
+	if err != nil {
+		return nil, err
+	}
+	// keep the precedence of binary expressions translated from a single call, e.g. spread(x) * 2
+	return parenIfBinaryExpr(result.expr), nil
+}
+
+// getVectorMatching matches the aggregated series on their grouping labels,
+// while series of different fields from the same point only differ in metric name.
+func getVectorMatching(expr promql.Expr) *promql.VectorMatching {
+	if grouping, ok := getExprGrouping(expr); ok {
+		return &promql.VectorMatching{
+			Card:           promql.CardOneToOne,
+			MatchingLabels: grouping,
+			On:             true,
+		}
+	}
+	return &promql.VectorMatching{
+		Card:           promql.CardOneToOne,
+		MatchingLabels: []string{labels.MetricName},
+	}
+}
+
+// getExprGrouping returns the grouping labels of the cross series aggregation
+// the vector expression results from.
+func getExprGrouping(expr promql.Expr) ([]string, bool) {
+	switch e := expr.(type) {
+	case *promql.AggregateExpr:
+		return e.Grouping, true
+	case *aggrFuncExpr:
+		return e.Grouping, true
+	case *groupedCallExpr:
+		return e.Grouping, true
+	case *promql.ParenExpr:
+		return getExprGrouping(e.Expr)
+	case *promql.BinaryExpr:
+		if e.LHS.Type() == promql.ValueTypeScalar {
+			return getExprGrouping(e.RHS)
+		}
+		return getExprGrouping(e.LHS)
+	case *binaryOpExpr:
+		return getExprGrouping(e.BinaryExpr)
+	case *promql.UnaryExpr:
+		return getExprGrouping(e.Expr)
+	case *promql.SubqueryExpr:
+		return getExprGrouping(e.Expr)
+	case *promql.Call:
+		for _, arg := range e.Args {
+			switch arg.Type() {
+			case promql.ValueTypeVector, promql.ValueTypeMatrix:
+				return getExprGrouping(arg)
+			}
+		}
+	}
+	return nil, false
+}
+
+func getSubQuerySource(sources influxql.Sources) (*influxql.SubQuery, bool) {
+	if len(sources) != 1 {
+		return nil, false
+	}
+	subQuery, ok := sources[0].(*influxql.SubQuery)
+	return subQuery, ok
+}
+
+// translateSubQueryField translates a field selected from a subquery, e.g.
+// SELECT max(m) FROM (SELECT mean(usage) AS m FROM cpu GROUP BY time(1m), host) GROUP BY time(1h).
+// The inner field referenced by the outer one is translated recursively and the
+// outer aggregators roll it up through MetricsQL subquery syntax:
+// max(max_over_time((avg by(host) (avg_over_time(cpu_usage[1m])))[1h:1m])).
+func (m *promQL) translateSubQueryField(s *influxql.SelectStatement, subQuery *influxql.SubQuery, field *influxql.Field) (*fieldResult, error) {
+	fieldName, err := getFieldVariable(field)
+	if err != nil {
+		return nil, errors.Wrap(err, "get subquery field variable")
+	}
+	innerField, err := getSubQueryField(subQuery.Statement, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	inner := &promQL{
+		metadata: m.metadata,
+		opts:     m.opts,
+	}
+	innerResult, err := inner.translateField(subQuery.Statement, innerField)
+	if err != nil {
+		return nil, errors.Wrapf(err, "translate subquery field %s", innerField)
+	}
+	// holt_winters of the subquery extends the time range of the statement
+	if inner.forecast > m.forecast {
+		m.forecast = inner.forecast
+	}
+	innerWin, _, err := inner.getGroups(subQuery.Statement.Dimensions)
+	if err != nil {
+		return nil, errors.Wrap(err, "get subquery groups")
+	}
+
+	aggrOps, err := getAggrOperators(field)
+	if err != nil {
+		return nil, errors.Wrap(err, "get field aggregate operator")
+	}
+	cond, timeRange, err := getTimeRange(s.Condition)
+	if err != nil {
+		return nil, errors.Wrap(err, "getTimeRange")
+	}
+	if timeRange == nil {
+		timeRange = inner.timeRange
+	}
+	m.timeRange = timeRange
+	if cond != nil {
+		return nil, errors.Errorf("conditions %q on subquery are not supported", cond)
+	}
+
+	lookbehindWin, groups, err := m.getGroups(s.Dimensions)
+	if err != nil {
+		return nil, errors.Wrap(err, "get groups")
+	}
+	if m.groupByOffset != 0 {
+		m.metadata.addWarning("GROUP BY time() offset %s over subquery isn't applied", model.Duration(m.groupByOffset))
+	}
+	var result promql.Expr = innerResult.expr
+	if _, rollupOps := splitTransformOperators(aggrOps); len(rollupOps) != 0 {
+		dur, err := parseLookbehindWindow(lookbehindWin)
+		if err != nil {
+			return nil, err
+		}
+		subqueryExpr := &promql.SubqueryExpr{
+			Expr:  &promql.ParenExpr{Expr: result},
+			Range: dur,
+		}
+		if innerWin != "" {
+			step, err := parseLookbehindWindow(innerWin)
+			if err != nil {
+				return nil, err
+			}
+			subqueryExpr.Step = step
+		}
+		result = subqueryExpr
+	}
+	expr, err := m.aggregateExpr(innerResult.metricName, result, lookbehindWin, aggrOps, groups)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate expression")
+	}
+	fieldResult := newFieldResult(innerResult.metricName, aggrOps, expr)
+	fieldResult.name = innerResult.name
+	return fieldResult, nil
+}
+
+// getSubQueryField finds the subquery field referenced by name from the outer
+// statement, the name is the alias or the name InfluxDB derives for the field.
+func getSubQueryField(s *influxql.SelectStatement, name string) (*influxql.Field, error) {
+	for _, field := range s.Fields {
+		if field.Name() == name {
+			return field, nil
+		}
+	}
+	return nil, errors.Errorf("field %q not found in subquery %s", name, s)
 }
 
 func (m *promQL) translate(s *influxql.SelectStatement) (string, error) {
 	exprs := make([]*fieldResult, 0)
 	var resultExpr promql.Expr
-	for _, field := range s.Fields {
-		m.labelsVisitor = newLabelsVisitor()
+	// rewrite SELECT DISTINCT x and count(DISTINCT x) into distinct(x) calls
+	s.RewriteDistinct()
+	m.sources = s.Sources
+	m.checkMeasurementNaming(s.Sources)
+	timeFields, selectFields := splitTimeFields(s.Fields)
+	fields := make(influxql.Fields, 0, len(selectFields))
+	for _, field := range selectFields {
+		// the selected tags are kept as the labels of the series
+		if !m.isTagField(field) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 && len(selectFields) != 0 {
+		return "", errors.Errorf("at least 1 non-tag field must be queried")
+	}
+	for _, field := range fields {
 		expr, err := m.translateField(s, field)
 		if err != nil {
 			return "", errors.Wrapf(err, "translate field %s", field)
 		}
+		expr.alias = field.Alias
 		exprs = append(exprs, expr)
 	}
+	var timeExpr *fieldResult
+	if len(timeFields) != 0 {
+		var err error
+		timeExpr, err = m.translateTimeField(fields, exprs)
+		if err != nil {
+			return "", errors.Wrapf(err, "translate field %s", timeFields[0])
+		}
+		if timeExpr != nil {
+			timeExpr.alias = timeFields[0].Alias
+		}
+	}
+	// the timestamps of the selected points aren't filled
+	for _, expr := range exprs {
+		filled, err := m.fillExpr(s, expr.expr)
+		if err != nil {
+			return "", errors.Wrap(err, "fill")
+		}
+		expr.expr = filled
+	}
+	if timeExpr != nil {
+		exprs = append([]*fieldResult{timeExpr}, exprs...)
+	}
+	m.extendForecastTimeRange()
 
 	if len(exprs) == 1 {
 		resultExpr = exprs[0].expr
@@ -159,7 +574,7 @@ func (m *promQL) translate(s *influxql.SelectStatement) (string, error) {
 		resultExpr = unionFieldsExpr(exprs)
 	}
 
-	return m.formatExpr(resultExpr), nil
+	return resultExpr.String(), nil
 }
 
 func unionFieldsExpr(exprs []*fieldResult) promql.Expr {
@@ -168,13 +583,16 @@ func unionFieldsExpr(exprs []*fieldResult) promql.Expr {
 	setKey := UNION_RESULT_NAME
 	for i := range exprs {
 		expr := exprs[i]
-		setValue := expr.metricName
+		setValue := expr.name
 		if len(expr.aggrOps) > 0 {
 			opsNames := make([]string, len(expr.aggrOps))
 			for i := range expr.aggrOps {
 				opsNames[i] = expr.aggrOps[i].Name
 			}
-			setValue = fmt.Sprintf("%s_%s", strings.Join(opsNames, "_"), expr.metricName)
+			setValue = fmt.Sprintf("%s_%s", strings.Join(opsNames, "_"), expr.name)
+		}
+		if expr.alias != "" {
+			setValue = expr.alias
 		}
 		result[i] = &promql.Call{
 			Func: &promql.Function{
@@ -185,8 +603,8 @@ func unionFieldsExpr(exprs []*fieldResult) promql.Expr {
 			},
 			Args: promql.Expressions{
 				expr.expr,
-				&promql.StringLiteral{setKey},
-				&promql.StringLiteral{setValue},
+				&promql.StringLiteral{Val: setKey},
+				&promql.StringLiteral{Val: setValue},
 			},
 		}
 	}
@@ -233,103 +651,439 @@ func getTimeRange(cond influxql.Expr) (influxql.Expr, *influxql.TimeRange, error
 	return cond, &timeRange, nil
 }
 
-func (m promQL) generateExpr(
+func (m *promQL) generateExpr(
 	metricName string,
-	ls []*labels.Matcher,
+	filters labelFilters,
+	fieldConds []*fieldCondition,
 	lookbehindWindow string,
 	aggrOps []*AggrOperator,
 	groups []string) (promql.Expr, error) {
-	//fmt.Printf("=====name: %s, labels: %#v, lookbehindWindow: %q, aggrOps: %#v, groups: %#v\n", metricName, ls, lookbehindWindow, aggrOps, groups)
-	for _, l := range ls {
-		fmt.Printf("label: %s\n", l.String())
-	}
-
 	if m.fieldIsWildcard {
-		measurementM, _ := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, fmt.Sprintf("^%s_.*", m.measurement))
-		ls = append(ls, measurementM)
+		measurementM, _ := labels.NewMatcher(labels.MatchRegexp, labels.MetricName, m.getMetricNameRegex(metricName))
+		filters = filters.withMatcher(measurementM)
 	}
 
 	var result promql.Expr
-	if len(aggrOps) != 0 {
-		if lookbehindWindow == "" {
-			lookbehindWindow = "1m"
+	_, rollupOps := splitTransformOperators(aggrOps)
+	switch {
+	case len(fieldConds) != 0:
+		result = m.newFieldFilterExpr(metricName, filters, fieldConds)
+		if len(rollupOps) != 0 {
+			// the filtered points are rolled up by a subquery at the default step
+			dur, err := parseLookbehindWindow(lookbehindWindow)
+			if err != nil {
+				return nil, err
+			}
+			m.metadata.addWarning("the points filtered by the field conditions are resampled at the query step before %s", rollupOps[0].Name)
+			result = &promql.SubqueryExpr{
+				Expr:  &promql.ParenExpr{Expr: result},
+				Range: dur,
+			}
 		}
-		dur, err := model.ParseDuration(lookbehindWindow)
+	case len(rollupOps) != 0:
+		dur, err := parseLookbehindWindow(lookbehindWindow)
 		if err != nil {
-			return nil, errors.Wrapf(err, "ParseDuration: %q", lookbehindWindow)
-		}
-		ms := &promql.MatrixSelector{
-			LabelMatchers: ls,
-			Range:         time.Duration(dur),
-		}
-		if !m.fieldIsWildcard && !m.fieldIsRegex {
-			ms.Name = metricName
-		}
-		result = ms
-	} else {
-		vs := &promql.VectorSelector{
-			LabelMatchers: ls,
-		}
-		if !m.fieldIsWildcard && !m.fieldIsRegex {
-			vs.Name = metricName
+			return nil, err
 		}
-		result = vs
+		result = m.withGroupByOffset(newMatrixSelector(m.getSelectorName(metricName), filters, dur))
+	default:
+		result = m.newVectorSelector(metricName, filters)
 	}
 
-	if len(groups) != 0 && len(aggrOps) == 0 {
-		return nil, errors.Errorf("Can't use group by when aggregate operator is empty")
+	return m.aggregateExpr(metricName, result, lookbehindWindow, aggrOps, groups)
+}
+
+// getSelectorName returns the metric name of the series selector, which is
+// empty when the metric names are matched by regex or can't be an identifier.
+func (m promQL) getSelectorName(metricName string) string {
+	if m.fieldIsWildcard || m.fieldIsRegex || !isValidMetricName(metricName) {
+		return ""
 	}
+	return metricName
+}
 
-	result = getAggrExpr(aggrOps, result)
+func (m promQL) newVectorSelector(metricName string, filters labelFilters) promql.Expr {
+	return m.withGroupByOffset(newVectorSelector(m.getSelectorName(metricName), filters))
+}
 
-	//fmt.Printf("=====m.GroupByWildcard: %v, %#v, aggrOps: %#v\n", m.groupByWildcard, result, aggrOps)
+// withGroupByOffset shifts the series selector forward by the GROUP BY time()
+// offset, so the rollup windows end at the offset bucket boundaries, e.g.
+// GROUP BY time(1h, 15m) => avg_over_time(m_x[1h] offset -15m).
+func (m promQL) withGroupByOffset(expr promql.Expr) promql.Expr {
+	if m.groupByOffset == 0 {
+		return expr
+	}
+	if shifted, ok := withOffset(expr, -m.groupByOffset); ok {
+		return shifted
+	}
+	return expr
+}
+
+// aggregateExpr applies the aggregate operators to the series expression and
+// merges the results of each group across series.
+func (m *promQL) aggregateExpr(metricName string, result promql.Expr, lookbehindWindow string, aggrOps []*AggrOperator, groups []string) (promql.Expr, error) {
+	transformOps, aggrOps := splitTransformOperators(aggrOps)
+	if len(groups) != 0 && len(aggrOps) == 0 {
+		return nil, errors.Errorf("Can't use group by when aggregate operator is empty")
+	}
+	interval, err := parseLookbehindWindow(lookbehindWindow)
+	if err != nil {
+		return nil, err
+	}
 
 	shouldSkipAggr := func(opName string) bool {
 		switch opName {
-		case CALL_PERCENTILE, CALL_TOP, CALL_BOTTOM, "last":
+		case CALL_TOP, CALL_BOTTOM:
 			return true
 		}
 		return false
 	}
+	crossSeries := len(aggrOps) != 0 && !shouldSkipAggr(aggrOps[0].Name) && !m.groupByWildcard
+	if crossSeries && (m.fieldIsWildcard || m.fieldVariableIsRegex) {
+		// the series of different fields can't be told apart after the rollup
+		// functions drop the metric names, so they are returned per series
+		m.metadata.addWarning("%s of the fields matched by %s isn't merged across the series of a group", aggrOps[0].Name, m.getMetricNameRegex(metricName))
+		crossSeries = false
+	}
 
-	if len(aggrOps) != 0 {
-		op := promql.ItemAvg
-		opName := aggrOps[0].Name
-		if !shouldSkipAggr(opName) {
-			switch opName {
-			case CALL_SUM:
-				op = promql.ItemSum
-			case CALL_MAX:
-				op = promql.ItemMax
-			case CALL_MIN:
-				op = promql.ItemMin
-			}
-			expr := &promql.AggregateExpr{
-				Op:   op,
-				Expr: result,
-			}
-			if len(groups) != 0 {
-				expr.Grouping = groups
+	if crossSeries && len(aggrOps) == 1 && aggrOps[0].Name == CALL_SPREAD {
+		// spread of a group is the difference between the max and min of all its points
+		result, err = m.newCrossSeriesSpreadExpr(metricName, result, groups)
+		if err != nil {
+			return nil, err
+		}
+		return m.applyTransformOperators(transformOps, result, interval, true)
+	}
+
+	if len(aggrOps) != 0 && aggrOps[len(aggrOps)-1].Name == CALL_DISTINCT {
+		result, err = m.newDistinctExpr(metricName, result, aggrOps, groups, crossSeries)
+		if err != nil {
+			return nil, err
+		}
+		return m.applyTransformOperators(transformOps, result, interval, true)
+	}
+
+	result = m.getAggrExpr(aggrOps, result)
+	if m.measurementIsRegex {
+		result = m.exposeMeasurementLabel(metricName, result)
+		if len(aggrOps) != 0 {
+			groups = append(groups, m.getMeasurementLabelName())
+		}
+	}
+
+	if crossSeries {
+		result, err = m.newCrossSeriesAggrExpr(aggrOps, result, groups)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(aggrOps) != 0 && shouldSkipAggr(aggrOps[0].Name) && len(groups) != 0 && !m.groupByWildcard {
+		result = withTopGrouping(result, groups)
+	}
+
+	return m.applyTransformOperators(transformOps, result, interval, len(aggrOps) != 0)
+}
+
+func (m *promQL) newCrossSeriesSpreadExpr(metricName string, result promql.Expr, groups []string) (promql.Expr, error) {
+	maxExpr, err := m.aggregateExpr(metricName, result, "", []*AggrOperator{newAggrOperatorByName(CALL_MAX)}, groups)
+	if err != nil {
+		return nil, err
+	}
+	minExpr, err := m.aggregateExpr(metricName, result, "", []*AggrOperator{newAggrOperatorByName(CALL_MIN)}, groups)
+	if err != nil {
+		return nil, err
+	}
+	return &promql.BinaryExpr{
+		Op:             promql.ItemSUB,
+		LHS:            maxExpr,
+		RHS:            minExpr,
+		VectorMatching: getVectorMatching(maxExpr),
+	}, nil
+}
+
+// newDistinctExpr translates distinct(x) and count(distinct(x)). The distinct
+// values of each series are put into the DISTINCT_VALUE_LABEL_NAME label by
+// count_values_over_time and deduplicated across the series of a group, then
+// they are either counted or converted back to values by label_value, e.g.
+// count(distinct(x)) GROUP BY host =>
+// count by(host) (count by(host, __distinct_value__) (count_values_over_time("__distinct_value__", m_x[1m]))).
+func (m *promQL) newDistinctExpr(metricName string, result promql.Expr, aggrOps []*AggrOperator, groups []string, crossSeries bool) (promql.Expr, error) {
+	isCount := len(aggrOps) == 2 && aggrOps[0].Name == CALL_COUNT
+	if len(aggrOps) != 1 && !isCount {
+		return nil, errors.Errorf("only count() is supported over distinct()")
+	}
+	groups = append([]string{}, groups...)
+	if isCount && !crossSeries {
+		// https://docs.victoriametrics.com/MetricsQL.html#distinct_over_time
+		result = newAggrExpr("distinct_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, result)
+		if m.measurementIsRegex {
+			result = m.exposeMeasurementLabel(metricName, result)
+		}
+		return result, nil
+	}
+
+	// https://docs.victoriametrics.com/MetricsQL.html#count_values_over_time
+	result = newAggrExprWithArgs("count_values_over_time",
+		[]promql.ValueType{promql.ValueTypeString, promql.ValueTypeMatrix},
+		promql.ValueTypeVector,
+		promql.Expressions{&promql.StringLiteral{Val: DISTINCT_VALUE_LABEL_NAME}, result})
+	if m.measurementIsRegex {
+		result = m.exposeMeasurementLabel(metricName, result)
+		groups = append(groups, m.getMeasurementLabelName())
+	}
+	if crossSeries {
+		result = &promql.AggregateExpr{
+			Op:       promql.ItemCount,
+			Expr:     result,
+			Grouping: append(append([]string{}, groups...), DISTINCT_VALUE_LABEL_NAME),
+		}
+	}
+	if isCount {
+		expr := &promql.AggregateExpr{
+			Op:   promql.ItemCount,
+			Expr: result,
+		}
+		if len(groups) != 0 {
+			expr.Grouping = groups
+		}
+		return expr, nil
+	}
+	// https://docs.victoriametrics.com/MetricsQL.html#label_value
+	return newAggrExprWithArgs("label_value",
+		[]promql.ValueType{promql.ValueTypeVector, promql.ValueTypeString},
+		promql.ValueTypeVector,
+		promql.Expressions{result, &promql.StringLiteral{Val: DISTINCT_VALUE_LABEL_NAME}}), nil
+}
+
+// newTopExpr translates top() and bottom() into the topk and bottomk flavour of
+// the options. The series are ranked by their max or min points, and when tags
+// are given, the series with the same tag values are merged first, e.g.
+// top(x, host, 5) => topk_avg(5, max by(host) (max_over_time(m_x[1m]))).
+func (m promQL) newTopExpr(op *AggrOperator, expr promql.Expr) promql.Expr {
+	name, rollup, aggr := "topk", "max_over_time", promql.ItemMax
+	if op.Name == CALL_BOTTOM {
+		name, rollup, aggr = "bottomk", "min_over_time", promql.ItemMin
+	}
+	expr = newAggrExpr(rollup, promql.ValueTypeMatrix, promql.ValueTypeVector, expr)
+	if len(op.Tags) != 0 {
+		tags := make([]string, len(op.Tags))
+		for i, tag := range op.Tags {
+			tags[i] = m.sanitizeLabelName(tag)
+		}
+		expr = &promql.AggregateExpr{
+			Op:       aggr,
+			Expr:     expr,
+			Grouping: tags,
+		}
+	}
+	return newAggrExprWithArgs(m.opts.topkFlavour.getFuncName(name),
+		[]promql.ValueType{
+			promql.ValueTypeScalar,
+			promql.ValueTypeVector,
+		}, promql.ValueTypeVector,
+		promql.Expressions{op.Args[0], expr})
+}
+
+// withTopGrouping ranks the series of top() and bottom() within each group of
+// the GROUP BY tags, e.g. top(x, 3) GROUP BY host =>
+// topk_avg(3, max_over_time(m_x[1m])) by(host), the series merged by the tag
+// arguments are kept apart by the groups too.
+func withTopGrouping(expr promql.Expr, groups []string) promql.Expr {
+	call, ok := expr.(*promql.Call)
+	if !ok || len(call.Args) != 2 {
+		return expr
+	}
+	if merged, ok := call.Args[1].(*promql.AggregateExpr); ok {
+		grouping := append([]string{}, groups...)
+	tags:
+		for _, tag := range merged.Grouping {
+			for _, group := range groups {
+				if tag == group {
+					continue tags
+				}
 			}
-			if !m.groupByWildcard {
-				result = expr
+			grouping = append(grouping, tag)
+		}
+		merged.Grouping = grouping
+	}
+	return newGroupedCallExpr(call, groups)
+}
+
+// getMetricNameRegex returns the regex pattern matching the metric names of a
+// regex or wildcard field.
+func (m promQL) getMetricNameRegex(metricName string) string {
+	if m.fieldIsWildcard {
+		measurement := m.measurement
+		if !m.measurementIsRegex {
+			measurement = regexp.QuoteMeta(measurement)
+		}
+		return m.getMetricPrefix(true) + m.opts.naming.GetMetricName(measurement, ".*", true)
+	}
+	return trimRegexDelimiters(metricName)
+}
+
+// exposeMeasurementLabel copies the measurement part of the metric name into
+// the MEASUREMENT_LABEL_NAME label, so series of different measurements stay
+// distinguishable after the rollup functions drop the metric name, e.g.
+// label_replace(avg_over_time({__name__=~"(net_eth0|net_eth1)_bytes"}[1m]) keep_metric_names,
+// "__measurement__", "$1", "__name__", "(net_eth0|net_eth1)_bytes").
+func (m promQL) exposeMeasurementLabel(metricName string, expr promql.Expr) promql.Expr {
+	if m.opts.naming.GetMeasurementLabel() != "" {
+		// the measurement is already a label of the series
+		return expr
+	}
+	labelReplace := func(expr promql.Expr) promql.Expr {
+		return newAggrExprWithArgs("label_replace",
+			[]promql.ValueType{
+				promql.ValueTypeVector,
+				promql.ValueTypeString,
+				promql.ValueTypeString,
+				promql.ValueTypeString,
+				promql.ValueTypeString,
+			}, promql.ValueTypeVector,
+			promql.Expressions{
+				expr,
+				&promql.StringLiteral{Val: MEASUREMENT_LABEL_NAME},
+				&promql.StringLiteral{Val: "$1"},
+				&promql.StringLiteral{Val: labels.MetricName},
+				&promql.StringLiteral{Val: m.getMetricNameRegex(metricName)},
+			})
+	}
+	switch e := expr.(type) {
+	case *promql.VectorSelector, *orVectorSelector:
+		return labelReplace(e)
+	case *promql.Call:
+		for i, arg := range e.Args {
+			switch arg.(type) {
+			case *promql.MatrixSelector, *orMatrixSelector, *promql.SubqueryExpr:
+				return labelReplace(newKeepMetricNamesExpr(e))
 			}
+			e.Args[i] = m.exposeMeasurementLabel(metricName, arg)
 		}
 	}
+	return expr
+}
+
+// parseLookbehindWindow parses the GROUP BY time() interval used as the
+// lookbehind window of rollup functions, which defaults to 1m.
+func parseLookbehindWindow(lookbehindWindow string) (time.Duration, error) {
+	if lookbehindWindow == "" {
+		lookbehindWindow = "1m"
+	}
+	dur, err := model.ParseDuration(lookbehindWindow)
+	if err != nil {
+		return 0, errors.Wrapf(err, "ParseDuration: %q", lookbehindWindow)
+	}
+	return time.Duration(dur), nil
+}
 
+// newCrossSeriesAggrExpr merges the per series rollup results of a group by
+// the aggregation decided by the innermost aggregator consuming the raw points.
+// E.g. InfluxQL count() of a group equals the sum of count_over_time() of each
+// series in the group.
+func (m promQL) newCrossSeriesAggrExpr(aggrOps []*AggrOperator, expr promql.Expr, groups []string) (promql.Expr, error) {
+	result := &promql.AggregateExpr{
+		Op:   promql.ItemAvg,
+		Expr: expr,
+	}
+	if len(groups) != 0 {
+		result.Grouping = groups
+	}
+	switch op := aggrOps[len(aggrOps)-1]; op.Name {
+	case CALL_MEAN:
+		// the mean of the points of a group is the sum of their values divided by their count
+		sum, sumOK := withRollupFunc(expr, "avg_over_time", "sum_over_time")
+		count, countOK := withRollupFunc(expr, "avg_over_time", "count_over_time")
+		if !sumOK || !countOK {
+			m.metadata.addWarning("%s of the points of a group can't be merged from its series, approximated by the average of the series %s", op.Name, op.Name)
+			break
+		}
+		lhs := &promql.AggregateExpr{Op: promql.ItemSum, Expr: sum, Grouping: result.Grouping}
+		return &promql.BinaryExpr{
+			Op:             promql.ItemDIV,
+			LHS:            lhs,
+			RHS:            &promql.AggregateExpr{Op: promql.ItemSum, Expr: count, Grouping: result.Grouping},
+			VectorMatching: getVectorMatching(lhs),
+		}, nil
+	case CALL_SUM, CALL_COUNT, CALL_INTEGRAL:
+		// the area under the points of a group is the sum of the areas of its series
+		result.Op = promql.ItemSum
+	case CALL_MAX:
+		result.Op = promql.ItemMax
+	case CALL_MIN:
+		result.Op = promql.ItemMin
+	case CALL_PERCENTILE:
+		// approximate the percentile of all points by the percentile of the series percentiles
+		m.metadata.addWarning("%s of the points of a group can't be merged from its series, approximated by the quantile of the series %s", op.Name, op.Name)
+		result.Op = promql.ItemQuantile
+		result.Param = op.Args[0]
+	case CALL_MEDIAN:
+		m.metadata.addWarning("%s of the points of a group can't be merged from its series, approximated by the median of the series %s", op.Name, op.Name)
+		result.Op = promql.ItemQuantile
+		result.Param = &promql.NumberLiteral{Val: 0.5}
+	case CALL_MODE:
+		m.metadata.addWarning("%s of the points of a group can't be merged from its series, approximated by the mode of the series %s", op.Name, op.Name)
+		// https://docs.victoriametrics.com/MetricsQL.html#mode
+		return newAggrFuncExpr(CALL_MODE, result), nil
+	case CALL_FIRST:
+		return newCrossSeriesSelectorExpr(promql.ItemMin, expr, result.Grouping)
+	case CALL_LAST, CALL_SAMPLE:
+		// the sample is approximated by the last point
+		return newCrossSeriesSelectorExpr(promql.ItemMax, expr, result.Grouping)
+	case CALL_STDDEV:
+		m.metadata.addWarning("%s of the points of a group can't be merged from its series, approximated by the average of the series %s", op.Name, op.Name)
+	}
 	return result, nil
 }
 
-func (m promQL) formatExpr(expr promql.Expr) string {
-	initialExpr := expr.String()
-	//fmt.Printf("---replaceLabels: %#v\n", m.labelsVisitor.replaceLabels)
-	//fmt.Printf("--src: %s\n", initialExpr)
-	if len(m.labelsVisitor.replaceLabels) > 0 && len(m.labelsVisitor.labels) > 1 {
-		for src, replace := range m.labelsVisitor.replaceLabels {
-			initialExpr = strings.ReplaceAll(initialExpr, src, replace)
+// withRollupFunc returns a copy of the rollup expression calling the function
+// to instead of from, e.g. avg_over_time(x[1m]) => sum_over_time(x[1m]).
+func withRollupFunc(expr promql.Expr, from, to string) (promql.Expr, bool) {
+	switch e := expr.(type) {
+	case *keepMetricNamesExpr:
+		replaced, ok := withRollupFunc(e.Call, from, to)
+		if !ok {
+			return nil, false
 		}
+		call, ok := replaced.(*promql.Call)
+		if !ok {
+			return nil, false
+		}
+		return newKeepMetricNamesExpr(call), true
+	case *promql.Call:
+		call := *e
+		if e.Func.Name == from {
+			fn := *e.Func
+			fn.Name = to
+			call.Func = &fn
+			return &call, true
+		}
+		call.Args = make(promql.Expressions, len(e.Args))
+		replaced := false
+		for i, arg := range e.Args {
+			call.Args[i] = arg
+			if replaced {
+				continue
+			}
+			if result, ok := withRollupFunc(arg, from, to); ok {
+				call.Args[i] = result
+				replaced = true
+			}
+		}
+		return &call, replaced
+	}
+	return nil, false
+}
+
+// checkPercentileMethod reports a warning that InfluxQL percentile picks the
+// point of the nearest rank, while MetricsQL quantiles interpolate between the
+// closest points, only the 0 and 100 percentiles are exact points. There is no
+// option for the nearest rank: the rank depends on the number of points of each
+// series, but the phi of quantile_over_time is the same for all of them.
+func (m promQL) checkPercentileMethod(op *AggrOperator) {
+	phi := op.Args[0].(*promql.NumberLiteral).Val
+	if phi != 0 && phi != 1 {
+		m.metadata.addWarning("nearest-rank percentile %v is approximated by the interpolated quantile", phi*100)
 	}
-	return initialExpr
 }
 
 func newAggrExpr(name string, argType promql.ValueType, returnType promql.ValueType, restExpr promql.Expr) promql.Expr {
@@ -348,65 +1102,63 @@ func newAggrExprWithArgs(name string, args []promql.ValueType, returnType promql
 	}
 }
 
-func getAggrExpr(ops []*AggrOperator, expr promql.Expr) promql.Expr {
+func (m promQL) getAggrExpr(ops []*AggrOperator, expr promql.Expr) promql.Expr {
 	if len(ops) == 0 {
 		return expr
 	}
 	aggrOp := ops[0]
 	restOps := ops[1:]
-	restExpr := getAggrExpr(restOps, expr)
+	restExpr := m.getAggrExpr(restOps, expr)
 	switch aggrOp.Name {
-	case "abs":
-		// https://prometheus.io/docs/prometheus/latest/querying/functions/#abs
-		expr = newAggrExpr("abs", promql.ValueTypeVector, promql.ValueTypeVector, restExpr)
-	case "mean":
+	case CALL_MEAN:
 		// https://docs.victoriametrics.com/MetricsQL.html#avg_over_time
 		expr = newAggrExpr("avg_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	case "last":
+	case CALL_FIRST:
+		// https://docs.victoriametrics.com/MetricsQL.html#first_over_time
+		expr = newAggrExpr("first_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
+	case CALL_LAST:
 		// https://docs.victoriametrics.com/MetricsQL.html#last_over_time
 		expr = newAggrExpr("last_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	case "stddev":
+	case CALL_SAMPLE:
+		// MetricsQL can't return random points, pick the last point as the sample
+		m.metadata.addWarning("%s can't select N random points, approximated by the last point", aggrOp.Name)
+		expr = newAggrExpr("last_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
+	case CALL_SPREAD:
+		// https://docs.victoriametrics.com/MetricsQL.html#range_over_time
+		expr = newAggrExpr("range_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
+	case CALL_STDDEV:
 		// https://prometheus.io/docs/prometheus/latest/querying/functions/#aggregation_over_time
 		expr = newAggrExpr("stddev_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	case "count":
-		// use count, not use 'count_over_time' https://docs.victoriametrics.com/MetricsQL.html#count_over_time
-		expr = newAggrExpr("count", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	case "median":
+	case CALL_COUNT:
+		// https://docs.victoriametrics.com/MetricsQL.html#count_over_time
+		expr = newAggrExpr("count_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
+	case CALL_MEDIAN:
 		// https://docs.victoriametrics.com/MetricsQL.html#median_over_time
 		expr = newAggrExpr("median_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	/*case "max":
+	case CALL_SUM:
+		// https://docs.victoriametrics.com/MetricsQL.html#sum_over_time
+		expr = newAggrExpr("sum_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
+	case CALL_MAX:
 		// https://docs.victoriametrics.com/MetricsQL.html#max_over_time
-		expr = newAggrExpr("max", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	case "min":
+		expr = newAggrExpr("max_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
+	case CALL_MIN:
 		// https://docs.victoriametrics.com/MetricsQL.html#min_over_time
-		expr = newAggrExpr("min", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)*/
-	case "mode":
+		expr = newAggrExpr("min_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
+	case CALL_MODE:
 		// https://docs.victoriametrics.com/MetricsQL.html#mode_over_time
 		expr = newAggrExpr("mode_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	case "integral":
+	case CALL_INTEGRAL:
 		// https://docs.victoriametrics.com/MetricsQL.html#integrate
-		expr = newAggrExpr("integrate", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	case "distinct":
-		expr = newAggrExpr("distinct", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-	case CALL_TOP:
-		expr = newAggrExprWithArgs("topk_avg",
-			[]promql.ValueType{
-				promql.ValueTypeString,
-				promql.ValueTypeMatrix,
-			}, promql.ValueTypeVector,
-			promql.Expressions{
-				aggrOp.Args[0],
-				restExpr})
-	case CALL_BOTTOM:
-		expr = newAggrExprWithArgs("bottomk_avg",
-			[]promql.ValueType{
-				promql.ValueTypeString,
-				promql.ValueTypeMatrix,
-			}, promql.ValueTypeVector,
-			promql.Expressions{
-				aggrOp.Args[0],
-				restExpr})
+		// integrate is in value * second, convert it to value * unit of integral(x, 1h)
+		unit := aggrOp.Unit
+		if unit == 0 {
+			unit = time.Second
+		}
+		expr = newUnitScaleExpr(newAggrExpr("integrate", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr), unit, time.Second)
+	case CALL_TOP, CALL_BOTTOM:
+		expr = m.newTopExpr(aggrOp, restExpr)
 	case CALL_PERCENTILE:
+		m.checkPercentileMethod(aggrOp)
 		expr = newAggrExprWithArgs("quantile_over_time",
 			[]promql.ValueType{
 				promql.ValueTypeString,
@@ -415,44 +1167,6 @@ func getAggrExpr(ops []*AggrOperator, expr promql.Expr) promql.Expr {
 			promql.Expressions{
 				aggrOp.Args[0],
 				restExpr})
-	case "non_negative_derivative":
-		// InfluxQL: non_negative_derivative(mean("field"), 1s) computes per-second non-negative rate of change
-		// MetricsQL: rate() is the equivalent for counter-like metrics
-		// Unwrap inner aggregation (e.g., avg_over_time) and apply rate() to the base metric
-		if callExpr, ok := restExpr.(*promql.Call); ok && len(callExpr.Args) > 0 {
-			expr = newAggrExpr("rate", promql.ValueTypeMatrix, promql.ValueTypeVector, callExpr.Args[0])
-		} else {
-			expr = newAggrExpr("rate", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-		}
-	case "derivative":
-		// InfluxQL: derivative(mean("field"), 1s) computes per-second rate of change (can be negative)
-		// MetricsQL: deriv() is the closest equivalent
-		if callExpr, ok := restExpr.(*promql.Call); ok && len(callExpr.Args) > 0 {
-			expr = newAggrExpr("deriv", promql.ValueTypeMatrix, promql.ValueTypeVector, callExpr.Args[0])
-		} else {
-			expr = newAggrExpr("deriv", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-		}
-	case "difference":
-		// InfluxQL: difference(mean("field")) computes difference between consecutive points
-		// MetricsQL: delta() is the closest equivalent
-		if callExpr, ok := restExpr.(*promql.Call); ok && len(callExpr.Args) > 0 {
-			expr = newAggrExpr("delta", promql.ValueTypeMatrix, promql.ValueTypeVector, callExpr.Args[0])
-		} else {
-			expr = newAggrExpr("delta", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-		}
-	case "non_negative_difference":
-		// InfluxQL: non_negative_difference() - like difference but only non-negative values
-		// MetricsQL: increase() is the closest equivalent
-		if callExpr, ok := restExpr.(*promql.Call); ok && len(callExpr.Args) > 0 {
-			expr = newAggrExpr("increase", promql.ValueTypeMatrix, promql.ValueTypeVector, callExpr.Args[0])
-		} else {
-			expr = newAggrExpr("increase", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
-		}
-	case "elapsed":
-		// elapsed is not directly supported, pass through
-	case "moving_average":
-		// moving_average is not directly supported, pass through as avg_over_time
-		expr = newAggrExpr("avg_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, restExpr)
 	}
 	return expr
 }
@@ -460,6 +1174,10 @@ func getAggrExpr(ops []*AggrOperator, expr promql.Expr) promql.Expr {
 type AggrOperator struct {
 	Name string
 	Args promql.Expressions
+	// Unit is the duration unit argument of functions like elapsed(x, 1s)
+	Unit time.Duration
+	// Tags are the tag arguments of top(x, tag1, tag2, N) and bottom(x, tag1, tag2, N)
+	Tags []string
 }
 
 func newAggrOperatorByName(name string) *AggrOperator {
@@ -469,26 +1187,83 @@ func newAggrOperatorByName(name string) *AggrOperator {
 }
 
 func getAggrOperator(op *influxql.Call) ([]*AggrOperator, error) {
-	if len(op.Args) != 1 && !MUL_ARGS_AGGREGATOR.Has(op.Name) && !hasDurationLiteralExtraArgs(op) {
+	if len(op.Args) != 1 && !hasMulArgs(op) {
 		return nil, errors.Errorf("not supported aggregator: %s with args: %#v", op.String(), op.Args)
 	}
 	aggOp := newAggrOperatorByName(op.Name)
-	if op.Name == CALL_TOP || op.Name == CALL_BOTTOM || op.Name == CALL_PERCENTILE {
+	if op.Name == CALL_TOP || op.Name == CALL_BOTTOM {
 		numStr := op.Args[len(op.Args)-1].String()
 		num, err := strconv.Atoi(numStr)
 		if err != nil {
 			return nil, errors.Wrapf(err, "parse top/bottom aggregator: %s", op)
 		}
-		numFloat := float64(num)
-		if op.Name == CALL_PERCENTILE {
-			if numFloat > 100 {
-				return nil, errors.Errorf("percentile %f is large than 100", numFloat)
-			}
-			numFloat = numFloat / 100
+		aggOp.Args = promql.Expressions{
+			&promql.NumberLiteral{Val: float64(num)},
+		}
+	}
+	if op.Name == CALL_PERCENTILE {
+		phi, err := getPercentileArg(op)
+		if err != nil {
+			return nil, err
 		}
 		aggOp.Args = promql.Expressions{
-			&promql.NumberLiteral{Val: numFloat},
+			&promql.NumberLiteral{Val: phi},
+		}
+	}
+	if op.Name == CALL_TOP || op.Name == CALL_BOTTOM {
+		for _, arg := range op.Args[1 : len(op.Args)-1] {
+			tag, ok := arg.(*influxql.VarRef)
+			if !ok {
+				return nil, errors.Errorf("%s tag arguments must be identifiers: %s", op.Name, op)
+			}
+			aggOp.Tags = append(aggOp.Tags, tag.Val)
+		}
+	}
+	if DURATION_UNIT_FUNCTIONS.Has(op.Name) && len(op.Args) == 2 {
+		unit, ok := op.Args[1].(*influxql.DurationLiteral)
+		if !ok {
+			return nil, errors.Errorf("%s unit argument must be a duration: %s", op.Name, op)
+		}
+		aggOp.Unit = unit.Val
+	}
+	if op.Name == CALL_HOLT_WINTERS || op.Name == CALL_HOLT_WINTERS_WITH_FIT {
+		if len(op.Args) != 3 {
+			return nil, errors.Errorf("%s requires 3 arguments: %s", op.Name, op)
+		}
+		for _, arg := range op.Args[1:] {
+			num, ok := arg.(*influxql.IntegerLiteral)
+			if !ok {
+				return nil, errors.Errorf("%s arguments N and S must be integers: %s", op.Name, op)
+			}
+			aggOp.Args = append(aggOp.Args, &promql.NumberLiteral{Val: float64(num.Val)})
+		}
+	}
+	if TECHNICAL_ANALYSIS_FUNCTIONS.Has(op.Name) {
+		args, err := getTechnicalAnalysisArgs(op)
+		if err != nil {
+			return nil, err
 		}
+		aggOp.Args = args
+	}
+	if op.Name == CALL_MOVING_AVERAGE {
+		if len(op.Args) != 2 {
+			return nil, errors.Errorf("%s requires 2 arguments: %s", op.Name, op)
+		}
+		n, ok := op.Args[1].(*influxql.IntegerLiteral)
+		if !ok || n.Val < 1 {
+			return nil, errors.Errorf("%s N must be a positive integer: %s", op.Name, op)
+		}
+		aggOp.Args = promql.Expressions{&promql.NumberLiteral{Val: float64(n.Val)}}
+	}
+	if op.Name == CALL_LOG || op.Name == CALL_POW {
+		if len(op.Args) != 2 {
+			return nil, errors.Errorf("%s requires 2 arguments: %s", op.Name, op)
+		}
+		arg, err := influxqlLiteralToPromqlExpr(op.Args[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %s argument: %s", op.Name, op)
+		}
+		aggOp.Args = promql.Expressions{arg}
 	}
 	ret := []*AggrOperator{aggOp}
 	args, ok := op.Args[0].(*influxql.Call)
@@ -503,63 +1278,124 @@ func getAggrOperator(op *influxql.Call) ([]*AggrOperator, error) {
 	return ret, nil
 }
 
+// getPercentileArg returns the quantile of percentile(x, N), N is an integer
+// or float between 0 and 100.
+func getPercentileArg(op *influxql.Call) (float64, error) {
+	if len(op.Args) != 2 {
+		return 0, errors.Errorf("%s requires 2 arguments: %s", op.Name, op)
+	}
+	var num float64
+	switch arg := op.Args[1].(type) {
+	case *influxql.IntegerLiteral:
+		num = float64(arg.Val)
+	case *influxql.NumberLiteral:
+		num = arg.Val
+	default:
+		return 0, errors.Errorf("%s N must be a number: %s", op.Name, op)
+	}
+	if num < 0 || num > 100 {
+		return 0, errors.Errorf("percentile %v is out of range [0, 100]", num)
+	}
+	// shift the decimal point to avoid the rounding error of num / 100, e.g. 99.9 => 0.999
+	return strconv.ParseFloat(strconv.FormatFloat(num, 'f', -1, 64)+"e-2", 64)
+}
+
 func getAggrOperators(field *influxql.Field) ([]*AggrOperator, error) {
 	switch expr := field.Expr.(type) {
 	case *influxql.Call:
 		return getAggrOperator(expr)
-	case *influxql.BinaryExpr:
-		return getBinaryExprAggrOperators(expr)
 	}
 	return nil, nil
 }
 
-func getBinaryExprAggrOperators(expr *influxql.BinaryExpr) ([]*AggrOperator, error) {
-	if call, ok := expr.LHS.(*influxql.Call); ok {
-		return getAggrOperator(call)
-	}
-	if call, ok := expr.RHS.(*influxql.Call); ok {
-		return getAggrOperator(call)
-	}
-	if binExpr, ok := expr.LHS.(*influxql.BinaryExpr); ok {
-		return getBinaryExprAggrOperators(binExpr)
-	}
-	if binExpr, ok := expr.RHS.(*influxql.BinaryExpr); ok {
-		return getBinaryExprAggrOperators(binExpr)
+// getMeasurement returns the measurement name of the sources, multiple or
+// regex measurements are joined into an alternation regex pattern like
+// (net_eth0|net_eth1). The measurement names are mapped by getName if it's given.
+func getMeasurement(sources influxql.Sources, getName func(string) string) (string, bool, error) {
+	if len(sources) == 0 {
+		return "", false, errors.Errorf("sources is empty")
+	}
+	patterns := make([]string, 0, len(sources))
+	for _, src := range sources {
+		measurement, ok := src.(*influxql.Measurement)
+		if !ok {
+			return "", false, errors.Errorf("source %#v is not measurement type", src)
+		}
+		if measurement.Regex != nil {
+			patterns = append(patterns, unanchorRegex(measurement.Regex.Val.String()))
+		} else {
+			name := measurement.Name
+			if getName != nil {
+				name = getName(name)
+			}
+			if len(sources) == 1 {
+				return name, false, nil
+			}
+			patterns = append(patterns, regexp.QuoteMeta(name))
+		}
 	}
-	return nil, nil
+	return fmt.Sprintf("(%s)", strings.Join(patterns, "|")), true, nil
 }
 
-func getMetricName(sources influxql.Sources, field *influxql.Field) (string, error) {
-	if len(sources) != 1 {
-		return "", errors.Errorf("sources %#v length doesn't equal 1", sources)
+func (m promQL) getMetricName(sources influxql.Sources, field *influxql.Field) (string, error) {
+	naming := m.opts.naming
+	fieldName, fieldErr := getFieldVariable(field)
+	isWildcard := errors.Cause(fieldErr) == ErrVariableIsWildcard
+	if fieldErr != nil && !isWildcard {
+		return "", fieldErr
 	}
-	src := sources[0]
-	measurement, ok := src.(*influxql.Measurement)
-	if !ok {
-		return "", errors.Errorf("source %#v is not measurement type", src)
+	isRegexField := isRegexMetricName(fieldName)
+	if !isWildcard && !isRegexField {
+		measurement, isRegex, err := getMeasurement(sources, nil)
+		if err != nil {
+			return "", err
+		}
+		if !isRegex || !naming.HasMeasurementInName() {
+			// the joined metric name is sanitized like the ingestion, e.g. the
+			// separator of cpu.usage => cpu_usage
+			return m.getMetricPrefix(false) + m.sanitizeMetricName(naming.GetMetricName(measurement, fieldName, false)), nil
+		}
 	}
 
-	var (
-		fieldName string
-		err       error
-	)
+	measurement, isRegex, err := getMeasurement(sources, m.sanitizeMetricName)
+	if err != nil {
+		return "", err
+	}
+	if !naming.HasMeasurementInName() {
+		// the regex measurements don't take part in the metric names
+		isRegex = false
+	}
+	if isWildcard {
+		return measurement, fieldErr
+	}
+	if !isRegexField {
+		fieldName = m.sanitizeMetricName(fieldName)
+	}
+	if isRegexField {
+		fieldName = trimRegexDelimiters(fieldName)
+	} else {
+		fieldName = regexp.QuoteMeta(fieldName)
+	}
+	if !isRegex {
+		measurement = regexp.QuoteMeta(measurement)
+	}
+	return fmt.Sprintf("/%s%s/", m.getMetricPrefix(true), naming.GetMetricName(measurement, fieldName, true)), nil
+}
 
+func getFieldVariable(field *influxql.Field) (string, error) {
 	switch expr := field.Expr.(type) {
 	case *influxql.VarRef:
-		fieldName = expr.Val
+		return expr.Val, nil
+	case *influxql.RegexLiteral:
+		return getRegexFieldVariable(expr), nil
 	case *influxql.Call:
-		fieldName, err = getCallVariable(expr)
+		return getCallVariable(expr)
 	case *influxql.BinaryExpr:
-		fieldName, err = getBinaryExprVariable(expr)
-	default:
-		return "", errors.Errorf("field.Expr %#v is not supported", expr)
-	}
-
-	if err != nil {
-		return measurement.Name, err
+		return getBinaryExprVariable(expr)
+	case *influxql.ParenExpr:
+		return getFieldVariable(&influxql.Field{Expr: expr.Expr})
 	}
-
-	return fmt.Sprintf("%s_%s", measurement.Name, fieldName), nil
+	return "", errors.Errorf("field.Expr %#v is not supported", field.Expr)
 }
 
 var (
@@ -573,6 +1409,16 @@ func isRegexMetricName(metricName string) bool {
 	return idx >= 0 && strings.HasSuffix(metricName, "/")
 }
 
+// getRegexFieldVariable returns the regex field delimited by forward slashes,
+// whose pattern matches the field names like InfluxQL, e.g. /.*usage.*/.
+func getRegexFieldVariable(re *influxql.RegexLiteral) string {
+	pattern := unanchorRegex(re.Val.String())
+	if hasRegexAlternatives(pattern) {
+		pattern = fmt.Sprintf("(?:%s)", pattern)
+	}
+	return fmt.Sprintf("/%s/", pattern)
+}
+
 // trimRegexDelimiters converts a metric name like "haproxy_/d(req|con)/" to "haproxy_d(req|con)"
 func trimRegexDelimiters(metricName string) string {
 	idx := strings.Index(metricName, "/")
@@ -586,15 +1432,21 @@ func trimRegexDelimiters(metricName string) string {
 	return prefix + regexPart
 }
 
-// hasDurationLiteralExtraArgs checks if a call has extra args that are all DurationLiterals or IntegerLiterals.
-// This handles functions like non_negative_derivative(mean("field"), 1s) where 1s is a duration parameter.
+// hasMulArgs checks if a call is allowed to have multiple args.
+func hasMulArgs(c *influxql.Call) bool {
+	return MUL_ARGS_AGGREGATOR.Has(c.Name) || TECHNICAL_ANALYSIS_FUNCTIONS.Has(c.Name) || hasDurationLiteralExtraArgs(c)
+}
+
+// hasDurationLiteralExtraArgs checks if a call has extra args that are all DurationLiterals or number literals.
+// This handles functions like non_negative_derivative(mean("field"), 1s) where 1s is a duration parameter,
+// or pow("field", 0.5) where 0.5 is a number parameter.
 func hasDurationLiteralExtraArgs(c *influxql.Call) bool {
 	if len(c.Args) <= 1 {
 		return false
 	}
 	for _, arg := range c.Args[1:] {
 		switch arg.(type) {
-		case *influxql.DurationLiteral, *influxql.IntegerLiteral:
+		case *influxql.DurationLiteral, *influxql.IntegerLiteral, *influxql.NumberLiteral:
 			continue
 		default:
 			return false
@@ -604,7 +1456,7 @@ func hasDurationLiteralExtraArgs(c *influxql.Call) bool {
 }
 
 func getCallVariable(c *influxql.Call) (string, error) {
-	if len(c.Args) != 1 && !MUL_ARGS_AGGREGATOR.Has(c.Name) && !hasDurationLiteralExtraArgs(c) {
+	if len(c.Args) != 1 && !hasMulArgs(c) {
 		return "", errors.Errorf("length of call %q args %#v != 1", c.Name, c.Args)
 	}
 	switch args := c.Args[0].(type) {
@@ -612,12 +1464,13 @@ func getCallVariable(c *influxql.Call) (string, error) {
 		return args.Val, nil
 	case *influxql.Wildcard:
 		return "", ErrVariableIsWildcard
+	case *influxql.RegexLiteral:
+		return getRegexFieldVariable(args), nil
 	case *influxql.Call:
 		return getCallVariable(args)
 	default:
 		return "", errors.Errorf("unsupported args %#v", args)
 	}
-	return c.Args[0].String(), nil
 }
 
 func getBinaryExprVariable(expr *influxql.BinaryExpr) (string, error) {
@@ -628,6 +1481,8 @@ func getBinaryExprVariable(expr *influxql.BinaryExpr) (string, error) {
 		return lhs.Val, nil
 	case *influxql.BinaryExpr:
 		return getBinaryExprVariable(lhs)
+	case *influxql.ParenExpr:
+		return getFieldVariable(&influxql.Field{Expr: lhs.Expr})
 	}
 	switch rhs := expr.RHS.(type) {
 	case *influxql.Call:
@@ -636,6 +1491,8 @@ func getBinaryExprVariable(expr *influxql.BinaryExpr) (string, error) {
 		return rhs.Val, nil
 	case *influxql.BinaryExpr:
 		return getBinaryExprVariable(rhs)
+	case *influxql.ParenExpr:
+		return getFieldVariable(&influxql.Field{Expr: rhs.Expr})
 	}
 	return "", errors.Errorf("BinaryExpr %#v doesn't contain a Call or VarRef", expr)
 }
@@ -652,6 +1509,18 @@ func influxqlOpToPromqlOp(op influxql.Token) (promql.ItemType, error) {
 		return promql.ItemDIV, nil
 	case influxql.MOD:
 		return promql.ItemMOD, nil
+	case influxql.EQ:
+		return promql.ItemEQL, nil
+	case influxql.NEQ:
+		return promql.ItemNEQ, nil
+	case influxql.LT:
+		return promql.ItemLSS, nil
+	case influxql.LTE:
+		return promql.ItemLTE, nil
+	case influxql.GT:
+		return promql.ItemGTR, nil
+	case influxql.GTE:
+		return promql.ItemGTE, nil
 	default:
 		return 0, errors.Errorf("unsupported influxql binary operator: %s", op)
 	}
@@ -663,144 +1532,15 @@ func influxqlLiteralToPromqlExpr(expr influxql.Expr) (promql.Expr, error) {
 		return &promql.NumberLiteral{Val: float64(v.Val)}, nil
 	case *influxql.NumberLiteral:
 		return &promql.NumberLiteral{Val: v.Val}, nil
-	default:
-		return nil, errors.Errorf("unsupported literal type %T in binary expression", expr)
-	}
-}
-
-func wrapBinaryExpr(binExpr *influxql.BinaryExpr, innerExpr promql.Expr) (promql.Expr, error) {
-	promOp, err := influxqlOpToPromqlOp(binExpr.Op)
-	if err != nil {
-		return nil, err
-	}
-
-	// Determine which side is the Call (already translated as innerExpr)
-	// and which side is the literal
-	var literalExpr promql.Expr
-	var lhs, rhs promql.Expr
-
-	switch binExpr.LHS.(type) {
-	case *influxql.Call, *influxql.BinaryExpr:
-		// LHS is the call side, RHS should be the literal
-		literalExpr, err = influxqlLiteralToPromqlExpr(binExpr.RHS)
-		if err != nil {
-			return nil, err
-		}
-		lhs = innerExpr
-		rhs = literalExpr
-	default:
-		// RHS is the call side, LHS should be the literal
-		literalExpr, err = influxqlLiteralToPromqlExpr(binExpr.LHS)
-		if err != nil {
-			return nil, err
+	case *influxql.BooleanLiteral:
+		// booleans are stored as 1 and 0
+		if v.Val {
+			return &promql.NumberLiteral{Val: 1}, nil
 		}
-		lhs = literalExpr
-		rhs = innerExpr
-	}
-
-	return &promql.BinaryExpr{
-		Op:  promOp,
-		LHS: lhs,
-		RHS: rhs,
-	}, nil
-}
-
-type labelsVisitor struct {
-	err           error
-	labels        []*labels.Matcher
-	curKey        string
-	curOp         influxql.Token
-	curVal        string
-	replaceLabels map[string]string
-}
-
-func newLabelsVisitor() *labelsVisitor {
-	return &labelsVisitor{
-		err:           nil,
-		labels:        make([]*labels.Matcher, 0),
-		replaceLabels: map[string]string{},
-	}
-}
-
-func (l *labelsVisitor) Error() error {
-	return l.err
-}
-
-func (l *labelsVisitor) Labels() []*labels.Matcher {
-	return l.labels
-}
-
-func (l *labelsVisitor) commitLabel() error {
-	if l.err != nil {
-		return l.err
-	}
-	var (
-		label *labels.Matcher
-		err   error
-	)
-	var promOP labels.MatchType
-	switch l.curOp {
-	case influxql.EQ:
-		promOP = labels.MatchEqual
-	case influxql.NEQ:
-		promOP = labels.MatchNotEqual
-	case influxql.EQREGEX:
-		promOP = labels.MatchRegexp
-	case influxql.NEQREGEX:
-		promOP = labels.MatchNotRegexp
+		return &promql.NumberLiteral{Val: 0}, nil
 	default:
-		return errors.Errorf("Not suport influxdb operator: %s", l.curOp)
-	}
-	label, err = labels.NewMatcher(promOP, l.curKey, l.curVal)
-	if err != nil {
-		return errors.Wrapf(err, "not supported operator: %q", l.curOp)
-	}
-
-	l.labels = append(l.labels, label)
-	return nil
-}
-
-func (l *labelsVisitor) Visit(node influxql.Node) influxql.Visitor {
-	//fmt.Printf("-- visit: %s, %#v\n", node, node)
-	if l.err != nil {
-		log.Printf("error happend: %v, visting skipped", l.err)
-		return l
-	}
-	switch expr := node.(type) {
-	case *influxql.BinaryExpr:
-		if expr.Op != influxql.OR && expr.Op != influxql.AND {
-			l.curOp = expr.Op
-		}
-		l.Visit(expr.LHS)
-		if expr.Op == influxql.OR {
-			curLabel := l.labels[len(l.labels)-1]
-			key := fmt.Sprintf("%s,", curLabel.String())
-			l.replaceLabels[key] = fmt.Sprintf("%s or ", curLabel.String())
-		}
-		l.Visit(expr.RHS)
-		return nil
-	case *influxql.VarRef:
-		l.curKey = expr.Val
-	case *influxql.StringLiteral:
-		l.curVal = expr.Val
-		if err := l.commitLabel(); err != nil {
-			l.err = err
-		}
-	case *influxql.RegexLiteral:
-		l.curVal = expr.Val.String()
-		if err := l.commitLabel(); err != nil {
-			l.err = err
-		}
-	}
-	return l
-}
-
-func (m promQL) getLabels(v *labelsVisitor, cond influxql.Expr) ([]*labels.Matcher, error) {
-	if cond == nil {
-		return nil, nil
+		return nil, errors.Errorf("unsupported literal type %T in binary expression", expr)
 	}
-	influxql.Walk(v, cond)
-	return v.Labels(), v.Error()
 }
 
 func (m *promQL) getGroups(groups influxql.Dimensions) (string, []string, error) {
@@ -808,6 +1548,7 @@ func (m *promQL) getGroups(groups influxql.Dimensions) (string, []string, error)
 	var (
 		lookbehindWindow string
 	)
+	m.groupByOffset = 0
 	for _, group := range groups {
 		tmpWin, grp, err := m.getGroup(group)
 		if err != nil {
@@ -823,6 +1564,39 @@ func (m *promQL) getGroups(groups influxql.Dimensions) (string, []string, error)
 	return lookbehindWindow, result, nil
 }
 
+// setGroupByTime records the interval and offset of GROUP BY time(interval, offset),
+// the offset is normalized into [0, interval) like InfluxDB, e.g. time(1d, -8h)
+// is offset by 16h.
+func (m *promQL) setGroupByTime(call *influxql.Call) error {
+	interval, ok := call.Args[0].(*influxql.DurationLiteral)
+	if !ok || interval.Val <= 0 {
+		// the interval is validated by the lookbehind window
+		return nil
+	}
+	m.metadata.GroupByInterval = interval.Val
+	m.metadata.GroupByOffset = 0
+	if len(call.Args) < 2 {
+		return nil
+	}
+	switch arg := call.Args[1].(type) {
+	case *influxql.DurationLiteral:
+		offset := arg.Val % interval.Val
+		if offset < 0 {
+			offset += interval.Val
+		}
+		m.groupByOffset = offset
+		m.metadata.GroupByOffset = offset
+	case *influxql.Call:
+		if arg.Name != "now" {
+			return errors.Errorf("invalid offset of %s", call)
+		}
+		m.metadata.addWarning("offset now() of %s depends on the query time, the buckets aren't offset", call)
+	default:
+		return errors.Errorf("invalid offset of %s", call)
+	}
+	return nil
+}
+
 func (m *promQL) getGroup(group *influxql.Dimension) (string, string, error) {
 	//fmt.Printf("---try group: %#v\n", group)
 	grp := group.Expr
@@ -830,11 +1604,20 @@ func (m *promQL) getGroup(group *influxql.Dimension) (string, string, error) {
 	switch expr := grp.(type) {
 	case *influxql.Call:
 		if expr.Name == "time" {
+			if len(expr.Args) != 1 && len(expr.Args) != 2 {
+				return "", "", errors.Errorf("time() expects 1 or 2 arguments, got %d: %s", len(expr.Args), expr)
+			}
 			lookbehindWindow = expr.Args[0].String()
+			if err := m.setGroupByTime(expr); err != nil {
+				return "", "", err
+			}
 		}
 		return lookbehindWindow, "", nil
 	case *influxql.VarRef:
-		return "", expr.Val, nil
+		if isFieldType(m.getKeyType(expr)) {
+			return "", "", errors.Errorf("can't group by field %s", expr.Val)
+		}
+		return "", m.sanitizeLabelName(expr.Val), nil
 	case *influxql.Wildcard:
 		m.groupByWildcard = true
 		return "", "", nil
@@ -2,6 +2,7 @@ package translator
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,6 +31,14 @@ func Test_metricsQL_getMetricName(t *testing.T) {
 			want:    "",
 			wantErr: true,
 		},
+		{
+			sql:  `SELECT mean(bytes) FROM net_eth0, net_eth1`,
+			want: "/(net_eth0|net_eth1)_bytes/",
+		},
+		{
+			sql:  `SELECT mean(bytes) FROM /^disk.*/`,
+			want: "/(disk.*)_bytes/",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.sql, func(t *testing.T) {
@@ -43,7 +52,7 @@ func Test_metricsQL_getMetricName(t *testing.T) {
 				t.Errorf("can't cast %#v to *influxql.SelectStatement", q)
 				return
 			}
-			got, err := getMetricName(sq.Sources, sq.Fields[0])
+			got, err := NewPromQL().(*promQL).getMetricName(sq.Sources, sq.Fields[0])
 			if (err != nil) != tt.wantErr {
 				t.Errorf("getMetricName() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -55,82 +64,118 @@ func Test_metricsQL_getMetricName(t *testing.T) {
 	}
 }
 
-func TestLabelsVisitor_Visit(t *testing.T) {
+func Test_promQL_getLabelFilters(t *testing.T) {
 	nMatcher := func(t labels.MatchType, n string, k string) *labels.Matcher {
 		l, _ := labels.NewMatcher(t, n, k)
 		return l
 	}
 	tests := []struct {
 		expr    string
-		want    []*labels.Matcher
+		want    labelFilters
 		wantErr bool
 	}{
 		{
 			expr: `host = 'server01'`,
-			want: []*labels.Matcher{
+			want: labelFilters{{
 				nMatcher(labels.MatchEqual, "host", "server01"),
-			},
+			}},
 		},
 		{
 			expr: `host != 'server01'`,
-			want: []*labels.Matcher{
+			want: labelFilters{{
 				nMatcher(labels.MatchNotEqual, "host", "server01"),
-			},
+			}},
 		},
 		{
 			expr: `hostname =~ /regexp/`,
-			want: []*labels.Matcher{
-				nMatcher(labels.MatchRegexp, "hostname", "regexp"),
-			},
+			want: labelFilters{{
+				nMatcher(labels.MatchRegexp, "hostname", ".*regexp.*"),
+			}},
 		},
 		{
 			expr: `hostname !~ /regexp/`,
-			want: []*labels.Matcher{
-				nMatcher(labels.MatchNotRegexp, "hostname", "regexp"),
-			},
+			want: labelFilters{{
+				nMatcher(labels.MatchNotRegexp, "hostname", ".*regexp.*"),
+			}},
 		},
 		{
 			expr: `hostname = 'office01' AND region =~ /uswest.*/`,
-			want: []*labels.Matcher{
+			want: labelFilters{{
 				nMatcher(labels.MatchEqual, "hostname", "office01"),
-				nMatcher(labels.MatchRegexp, "region", "uswest.*"),
-			},
+				nMatcher(labels.MatchRegexp, "region", ".*uswest.*"),
+			}},
 		},
 		{
 			expr: `hostname = 'office01' or region =~ /uswest.*/`,
-			want: []*labels.Matcher{
-				nMatcher(labels.MatchEqual, "hostname", "office01"),
-				nMatcher(labels.MatchRegexp, "region", "uswest.*"),
+			want: labelFilters{
+				{nMatcher(labels.MatchEqual, "hostname", "office01")},
+				{nMatcher(labels.MatchRegexp, "region", ".*uswest.*")},
 			},
 		},
+		{
+			expr: `(a = '1' OR b = '2') AND c = '3'`,
+			want: labelFilters{
+				{nMatcher(labels.MatchEqual, "a", "1"), nMatcher(labels.MatchEqual, "c", "3")},
+				{nMatcher(labels.MatchEqual, "b", "2"), nMatcher(labels.MatchEqual, "c", "3")},
+			},
+		},
+		{
+			expr: `(a = '1' OR (b = '2' AND (c = '3' OR d = '4'))) AND e = '5'`,
+			want: labelFilters{
+				{nMatcher(labels.MatchEqual, "a", "1"), nMatcher(labels.MatchEqual, "e", "5")},
+				{nMatcher(labels.MatchEqual, "b", "2"), nMatcher(labels.MatchEqual, "c", "3"), nMatcher(labels.MatchEqual, "e", "5")},
+				{nMatcher(labels.MatchEqual, "b", "2"), nMatcher(labels.MatchEqual, "d", "4"), nMatcher(labels.MatchEqual, "e", "5")},
+			},
+		},
+		{
+			expr:    `host = 1`,
+			wantErr: true,
+		},
+		{
+			expr:    strings.TrimSuffix(strings.Repeat(`(a = '1' OR b = '2') AND `, 7), ` AND `),
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.expr, func(t *testing.T) {
-			l := newLabelsVisitor()
 			expr, err := influxql.ParseExpr(tt.expr)
 			if err != nil {
 				t.Errorf("ParseExpr %q, error: %v", tt.expr, err)
 				return
 			}
-			influxql.Walk(l, expr)
-			if tt.wantErr {
-				if l.Error() == nil {
-					t.Errorf("no error happened, got: %v", l.Labels())
-				}
-			} else {
-				if got := l.labels; !reflect.DeepEqual(got, tt.want) {
-					t.Errorf("After Visited labels = %v, want %v, error: %v", got, tt.want, l.Error())
-				}
+			got, err := promQL{}.getLabelFilters(expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getLabelFilters() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) && !tt.wantErr {
+				t.Errorf("getLabelFilters() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
 func Test_metricsQL_Translate(t *testing.T) {
+	downsampledRetentionPolicy := WithRetentionPolicyMapping(RetentionPolicyMappingFunc(func(database string, retentionPolicy string) (*RetentionPolicy, error) {
+		if retentionPolicy != "1y" {
+			return nil, nil
+		}
+		return &RetentionPolicy{
+			Labels:       map[string]string{"vm_account_id": "1"},
+			MetricPrefix: "downsampled_",
+		}, nil
+	}))
+	cpuSchema := WithSchema(StaticSchema{
+		"cpu": {Tags: []string{"host", "cpu"}, Fields: []string{"usage_idle", "usage_user"}},
+	})
 	tests := []struct {
-		sql     string
-		want    string
-		wantErr bool
+		sql          string
+		opts         []Option
+		want         string
+		wantErr      bool
+		wantWarnings int
+		wantRange    *influxql.TimeRange
+		wantMetadata *Metadata
 	}{
 		{
 			sql:     "select free from disk",
@@ -159,12 +204,12 @@ func Test_metricsQL_Translate(t *testing.T) {
 		},
 		{
 			sql:     `SELECT mean("in") FROM "swap" WHERE host =~ /$hostname$/ GROUP BY time(2d), host`,
-			want:    `avg by(host) (avg_over_time(swap_in{host=~"$hostname$"}[2d]))`,
+			want:    `sum by(host) (sum_over_time(swap_in{host=~".*$hostname"}[2d])) / on(host) sum by(host) (count_over_time(swap_in{host=~".*$hostname"}[2d]))`,
 			wantErr: false,
 		},
 		{
 			sql:     `SELECT mean("in") FROM "swap" WHERE host =~ /$hostname$/ GROUP BY time(2d), *`,
-			want:    `avg_over_time(swap_in{host=~"$hostname$"}[2d])`,
+			want:    `avg_over_time(swap_in{host=~".*$hostname"}[2d])`,
 			wantErr: false,
 		},
 		{
@@ -172,59 +217,864 @@ func Test_metricsQL_Translate(t *testing.T) {
 			want:    `last_over_time(system_uptime[1m])`,
 			wantErr: false,
 		},
-		//{
-		//	sql:     `SELECT last("exit_status") FROM "smart_device" WHERE "health_ok" = false AND time > now() - 1h GROUP BY *`,
-		//	want:    `last_over_time(exit_status{health_ok=false}[1m])`,
-		//	wantErr: false,
-		//},
+		{
+			sql:          `SELECT last("exit_status") FROM "smart_device" WHERE "health_ok" = false AND time > now() - 1h GROUP BY *`,
+			want:         `last_over_time((smart_device_exit_status and smart_device_health_ok == 0)[1m:])`,
+			wantErr:      false,
+			wantWarnings: 1,
+		},
 		{
 			sql:  `SELECT mean("usage_active") FROM "cpu" WHERE "res_type" = 'host' AND time > now() - 1h GROUP BY "host_id"`,
-			want: `avg by(host_id) (avg_over_time(cpu_usage_active{res_type="host"}[1m]))`,
+			want: `sum by(host_id) (sum_over_time(cpu_usage_active{res_type="host"}[1m])) / on(host_id) sum by(host_id) (count_over_time(cpu_usage_active{res_type="host"}[1m]))`,
 		},
 		{
 			sql:  `SELECT abs(mean("bps_recv")) FROM "vm_netio" WHERE "project_domain" != '' AND time > now() - 10080m GROUP BY "vm_name", "vm_id", time(7d) fill(none)`,
-			want: `avg by(vm_name, vm_id) (abs(avg_over_time(vm_netio_bps_recv{project_domain!=""}[1w])))`,
+			want: `abs(sum by(vm_name, vm_id) (sum_over_time(vm_netio_bps_recv{project_domain!=""}[1w])) / on(vm_name, vm_id) sum by(vm_name, vm_id) (count_over_time(vm_netio_bps_recv{project_domain!=""}[1w])))`,
 		},
 		{
-			sql:  `SELECT last(*) FROM mem WHERE time > now() - 1h`,
-			want: `last_over_time({__name__=~"^mem_.*"}[1m])`,
+			sql:          `SELECT last(*) FROM mem WHERE time > now() - 1h`,
+			want:         `last_over_time({__name__=~"mem_.*"}[1m])`,
+			wantWarnings: 1,
 		},
 		{
 			sql:  `SELECT count("usage_active") FROM "vm_cpu" WHERE ("db" = 'telegraf' AND "host" = 'test-69-onecloud01-10-127-100-2') AND time > now() - 1h GROUP BY *, time(2m) fill(none)`,
-			want: `count(vm_cpu_usage_active{db="telegraf",host="test-69-onecloud01-10-127-100-2"}[2m])`,
+			want: `count_over_time(vm_cpu_usage_active{db="telegraf",host="test-69-onecloud01-10-127-100-2"}[2m])`,
 		},
 		{
 			sql:  `SELECT sum("bps_recv") FROM "vm_netio" WHERE "db" = 'telegraf' AND time > now() - 1h GROUP BY "host", time(2m) fill(none)`,
-			want: `sum by(host) (vm_netio_bps_recv{db="telegraf"}[2m])`,
+			want: `sum by(host) (sum_over_time(vm_netio_bps_recv{db="telegraf"}[2m]))`,
 		},
 		{
 			sql:  `SELECT min("bps_recv") FROM "vm_netio" WHERE "db" = 'telegraf' AND time > now() - 1h GROUP BY "host", time(2m) fill(none)`,
-			want: `min by(host) (vm_netio_bps_recv{db="telegraf"}[2m])`,
+			want: `min by(host) (min_over_time(vm_netio_bps_recv{db="telegraf"}[2m]))`,
+		},
+		{
+			sql:  `SELECT max("bps_recv") FROM "vm_netio" WHERE "db" = 'telegraf' AND time > now() - 1h GROUP BY "host", time(2m) fill(none)`,
+			want: `max by(host) (max_over_time(vm_netio_bps_recv{db="telegraf"}[2m]))`,
+		},
+		{
+			sql:  `SELECT count("bps_recv") FROM "vm_netio" WHERE "db" = 'telegraf' AND time > now() - 1h GROUP BY "host", time(2m) fill(none)`,
+			want: `sum by(host) (count_over_time(vm_netio_bps_recv{db="telegraf"}[2m]))`,
 		},
 		{
 			sql:  `SELECT sum("free"), sum("used"), sum("total") FROM "disk" WHERE time > now() - 720h GROUP BY fill(none)`,
-			want: `union(label_set(sum(disk_free[1m]), "__union_result__", "sum_disk_free"), label_set(sum(disk_used[1m]), "__union_result__", "sum_disk_used"), label_set(sum(disk_total[1m]), "__union_result__", "sum_disk_total"))`,
+			want: `union(label_set(sum(sum_over_time(disk_free[1m])), "__union_result__", "sum_disk_free"), label_set(sum(sum_over_time(disk_used[1m])), "__union_result__", "sum_disk_used"), label_set(sum(sum_over_time(disk_total[1m])), "__union_result__", "sum_disk_total"))`,
 		},
 		{
 			sql:  `SELECT top("usage_active", "vm_name", "vm_id", 5) FROM "vm_cpu" WHERE ("project_domain" != '' AND "project_tags.0.0.key" = 'user:L2.1')`,
-			want: `topk_avg(5, vm_cpu_usage_active{project_domain!="",project_tags.0.0.key="user:L2.1"}[1m])`,
+			want: `topk_avg(5, max by(vm_name, vm_id) (max_over_time(vm_cpu_usage_active{project_domain!="",project_tags\.0\.0\.key="user:L2.1"}[1m])))`,
 		},
 		{
 			sql:  `SELECT bottom("usage_active", "vm_name", "vm_id", 5) FROM "vm_cpu" WHERE ("project_domain" != '' AND "project_tags.0.0.key" = 'user:L2.1')`,
-			want: `bottomk_avg(5, vm_cpu_usage_active{project_domain!="",project_tags.0.0.key="user:L2.1"}[1m])`,
+			want: `bottomk_avg(5, min by(vm_name, vm_id) (min_over_time(vm_cpu_usage_active{project_domain!="",project_tags\.0\.0\.key="user:L2.1"}[1m])))`,
+		},
+		{
+			sql:          `SELECT percentile("bps_recv", 95) FROM "vm_netio" WHERE "vm_id" = 'cdc9df53-7175-42b4-8ea9-04139d18825a' AND time > now() - 10080m GROUP BY time(7d)`,
+			want:         `quantile(0.95, quantile_over_time(0.95, vm_netio_bps_recv{vm_id="cdc9df53-7175-42b4-8ea9-04139d18825a"}[1w]))`,
+			wantWarnings: 2,
+		},
+		{
+			sql:  `SELECT mean(bytes) FROM net_eth0, net_eth1 GROUP BY time(5m), host`,
+			want: `sum by(host, __measurement__) (label_replace(sum_over_time({__name__=~"(net_eth0|net_eth1)_bytes"}[5m]) keep_metric_names, "__measurement__", "$1", "__name__", "(net_eth0|net_eth1)_bytes")) / on(host, __measurement__) sum by(host, __measurement__) (label_replace(count_over_time({__name__=~"(net_eth0|net_eth1)_bytes"}[5m]) keep_metric_names, "__measurement__", "$1", "__name__", "(net_eth0|net_eth1)_bytes"))`,
+		},
+		{
+			sql:  `SELECT bytes FROM /^disk.*/ WHERE host = 'a'`,
+			want: `label_replace({host="a",__name__=~"(disk.*)_bytes"}, "__measurement__", "$1", "__name__", "(disk.*)_bytes")`,
+		},
+		{
+			sql:          `SELECT last(*) FROM net_eth0, net_eth1`,
+			want:         `label_replace(last_over_time({__name__=~"(net_eth0|net_eth1)_.*"}[1m]) keep_metric_names, "__measurement__", "$1", "__name__", "(net_eth0|net_eth1)_.*")`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT used / total * 100 FROM disk WHERE host = 'a'`,
+			want: `disk_used{host="a"} / ignoring(__name__) disk_total{host="a"} * 100`,
+		},
+		{
+			sql:  `SELECT (used + free) / total FROM disk`,
+			want: `(disk_used + ignoring(__name__) disk_free) / ignoring(__name__) disk_total`,
+		},
+		{
+			sql:  `SELECT (used + free) FROM disk`,
+			want: `(disk_used + ignoring(__name__) disk_free)`,
+		},
+		{
+			sql:  `SELECT 100 - idle FROM cpu`,
+			want: `100 - cpu_idle`,
+		},
+		{
+			sql:  `SELECT mean(used) / mean(total) FROM mem WHERE host =~ /web/ GROUP BY time(5m), host`,
+			want: `(sum by(host) (sum_over_time(mem_used{host=~".*web.*"}[5m])) / on(host) sum by(host) (count_over_time(mem_used{host=~".*web.*"}[5m]))) / on(host) (sum by(host) (sum_over_time(mem_total{host=~".*web.*"}[5m])) / on(host) sum by(host) (count_over_time(mem_total{host=~".*web.*"}[5m])))`,
+		},
+		{
+			sql:  `SELECT (sum(used) + sum(buffered)) / (sum(total) * 2) * 100 FROM mem GROUP BY time(5m)`,
+			want: `(sum(sum_over_time(mem_used[5m])) + on() sum(sum_over_time(mem_buffered[5m]))) / on() (sum(sum_over_time(mem_total[5m])) * 2) * 100`,
+		},
+		{
+			sql:  `SELECT mean(used) * 100 FROM mem GROUP BY time(5m), host`,
+			want: `(sum by(host) (sum_over_time(mem_used[5m])) / on(host) sum by(host) (count_over_time(mem_used[5m]))) * 100`,
+		},
+		{
+			sql:  `SELECT last(used) / last(total) FROM mem GROUP BY *`,
+			want: `last_over_time(mem_used[1m]) / ignoring(__name__) last_over_time(mem_total[1m])`,
+		},
+		{
+			sql:  `SELECT abs(free) FROM disk`,
+			want: `abs(disk_free) keep_metric_names`,
+		},
+		{
+			sql:  `SELECT round(sqrt(free)) FROM disk`,
+			want: `round(sqrt(disk_free) keep_metric_names) keep_metric_names`,
+		},
+		{
+			sql:  `SELECT ceil(mean(free)), floor(max(free)) FROM disk GROUP BY time(5m), host`,
+			want: `union(label_set(ceil(sum by(host) (sum_over_time(disk_free[5m])) / on(host) sum by(host) (count_over_time(disk_free[5m]))), "__union_result__", "ceil_mean_disk_free"), label_set(floor(max by(host) (max_over_time(disk_free[5m]))), "__union_result__", "floor_max_disk_free"))`,
+		},
+		{
+			sql:  `SELECT ln(free), log2(free), log10(free), exp(free) FROM disk`,
+			want: `union(label_set(ln(disk_free) keep_metric_names, "__union_result__", "ln_disk_free"), label_set(log2(disk_free) keep_metric_names, "__union_result__", "log2_disk_free"), label_set(log10(disk_free) keep_metric_names, "__union_result__", "log10_disk_free"), label_set(exp(disk_free) keep_metric_names, "__union_result__", "exp_disk_free"))`,
+		},
+		{
+			sql:  `SELECT log(mean(free), 3) FROM disk GROUP BY time(5m)`,
+			want: `ln(sum(sum_over_time(disk_free[5m])) / on() sum(count_over_time(disk_free[5m]))) / ln(3)`,
+		},
+		{
+			sql:  `SELECT log(free, 10) FROM disk`,
+			want: `log10(disk_free) keep_metric_names`,
+		},
+		{
+			sql:  `SELECT pow(mean(free), 2) FROM disk GROUP BY time(5m)`,
+			want: `(sum(sum_over_time(disk_free[5m])) / on() sum(count_over_time(disk_free[5m]))) ^ 2`,
+		},
+		{
+			sql:  `SELECT pow(free, 2) AS squared, free FROM disk`,
+			want: `union(label_set(disk_free ^ 2, "__union_result__", "squared"), label_set(disk_free, "__union_result__", "disk_free"))`,
+		},
+		{
+			sql:  `SELECT pow(free, 2), free FROM disk`,
+			want: `union(label_set(disk_free ^ 2, "__union_result__", "pow_disk_free"), label_set(disk_free, "__union_result__", "disk_free"))`,
+		},
+		{
+			sql:  `SELECT sqrt(pow(free, 0.5)) FROM disk`,
+			want: `sqrt(disk_free ^ 0.5) keep_metric_names`,
+		},
+		{
+			sql:  `SELECT sin(free), cos(free), tan(free), asin(free), acos(free), atan(free) FROM disk`,
+			want: `union(label_set(sin(disk_free) keep_metric_names, "__union_result__", "sin_disk_free"), label_set(cos(disk_free) keep_metric_names, "__union_result__", "cos_disk_free"), label_set(tan(disk_free) keep_metric_names, "__union_result__", "tan_disk_free"), label_set(asin(disk_free) keep_metric_names, "__union_result__", "asin_disk_free"), label_set(acos(disk_free) keep_metric_names, "__union_result__", "acos_disk_free"), label_set(atan(disk_free) keep_metric_names, "__union_result__", "atan_disk_free"))`,
+		},
+		{
+			sql:  `SELECT atan2(mean(y), mean(x)) FROM pos GROUP BY time(1m), host`,
+			want: `(sum by(host) (sum_over_time(pos_y[1m])) / on(host) sum by(host) (count_over_time(pos_y[1m]))) atan2 on(host) (sum by(host) (sum_over_time(pos_x[1m])) / on(host) sum by(host) (count_over_time(pos_x[1m])))`,
+		},
+		{
+			sql:  `SELECT atan2(y, 2) FROM pos`,
+			want: `pos_y atan2 2`,
+		},
+		{
+			sql:  `SELECT 2 / atan2(y, x) FROM pos`,
+			want: `2 / (pos_y atan2 ignoring(__name__) pos_x)`,
+		},
+		{
+			sql:  `SELECT atan2(y, x) * 2 FROM pos`,
+			want: `(pos_y atan2 ignoring(__name__) pos_x) * 2`,
+		},
+		{
+			sql:  `SELECT atan2(y, x) / atan2(x, y) FROM pos`,
+			want: `(pos_y atan2 ignoring(__name__) pos_x) / ignoring(__name__) (pos_x atan2 ignoring(__name__) pos_y)`,
+		},
+		{
+			sql:  `SELECT y * atan2(y, x) FROM pos`,
+			want: `pos_y * ignoring(__name__) (pos_y atan2 ignoring(__name__) pos_x)`,
+		},
+		{
+			sql:  `SELECT cumulative_sum(mean(bytes)) FROM net GROUP BY time(10m), host`,
+			want: `running_sum(sum by(host) (sum_over_time(net_bytes[10m])) / on(host) sum by(host) (count_over_time(net_bytes[10m])))`,
+		},
+		{
+			sql:  `SELECT cumulative_sum(bytes) FROM net`,
+			want: `running_sum(net_bytes)`,
+		},
+		{
+			sql:  `SELECT spread(bytes) FROM net WHERE time > now() - 1h GROUP BY time(10m), host`,
+			want: `max by(host) (max_over_time(net_bytes[10m])) - on(host) min by(host) (min_over_time(net_bytes[10m]))`,
+		},
+		{
+			sql:  `SELECT spread(bytes) FROM net GROUP BY time(10m), *`,
+			want: `range_over_time(net_bytes[10m])`,
+		},
+		{
+			sql:  `SELECT abs(spread(bytes)) FROM net GROUP BY time(10m)`,
+			want: `abs(max(max_over_time(net_bytes[10m])) - on() min(min_over_time(net_bytes[10m])))`,
+		},
+		{
+			sql:          `SELECT elapsed(bytes, 1s) FROM net`,
+			want:         `scrape_interval(net_bytes[1m])`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT elapsed(bytes) FROM net`,
+			want:         `scrape_interval(net_bytes[1m]) * 1e+09`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT elapsed(mean(bytes), 1m) FROM net GROUP BY time(10m)`,
+			want: `(sum(sum_over_time(net_bytes[10m])) / on() sum(count_over_time(net_bytes[10m]))) * 0 + 10`,
+		},
+		{
+			sql:          `SELECT sample(bytes, 1) FROM net GROUP BY time(10m), host`,
+			want:         `max by(host) (last_over_time(net_bytes[10m]) and tlast_over_time(net_bytes[10m]) == on(host) group_left() max by(host) (tlast_over_time(net_bytes[10m])))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT moving_average(mean(usage), 5) FROM cpu GROUP BY time(1m)`,
+			want: `avg_over_time((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[5m:1m])`,
+		},
+		{
+			sql:  `SELECT moving_average(max(usage), 3) FROM cpu GROUP BY time(10m), host`,
+			want: `avg_over_time((max by(host) (max_over_time(cpu_usage[10m])))[30m:10m])`,
+		},
+		{
+			sql:          `SELECT moving_average(usage, 2) FROM cpu`,
+			want:         `avg_over_time((cpu_usage)[2m:1m])`,
+			wantWarnings: 1,
+		},
+		{
+			sql:     `SELECT moving_average(mean(usage), 0) FROM cpu GROUP BY time(1m)`,
+			wantErr: true,
+		},
+		{
+			sql:  `SELECT non_negative_derivative(mean(bytes_recv), 1m) FROM net WHERE host = 'a' GROUP BY time(1m), host`,
+			want: `delta((sum by(host) (sum_over_time(net_bytes_recv{host="a"}[1m])) / on(host) sum by(host) (count_over_time(net_bytes_recv{host="a"}[1m])))[1m:1m]) >= 0`,
+		},
+		{
+			sql:  `SELECT non_negative_derivative(mean(bytes_recv), 1s) FROM net GROUP BY time(1m)`,
+			want: `delta((sum(sum_over_time(net_bytes_recv[1m])) / on() sum(count_over_time(net_bytes_recv[1m])))[1m:1m]) / 60 >= 0`,
+		},
+		{
+			sql:  `SELECT derivative(max(bytes_recv), 1h) FROM net GROUP BY time(10m)`,
+			want: `delta((max(max_over_time(net_bytes_recv[10m])))[10m:10m]) * 6`,
+		},
+		{
+			sql:  `SELECT derivative(bytes_recv) FROM net`,
+			want: `ideriv(net_bytes_recv[1m])`,
+		},
+		{
+			sql:  `SELECT non_negative_derivative(bytes_recv, 1m) FROM net`,
+			want: `ideriv(net_bytes_recv[1m]) * 60 >= 0`,
+		},
+		{
+			sql:  `SELECT difference(sum(bytes_recv)) FROM net GROUP BY time(5m), host`,
+			want: `delta((sum by(host) (sum_over_time(net_bytes_recv[5m])))[5m:5m])`,
+		},
+		{
+			sql:  `SELECT non_negative_difference(last(bytes_recv)) FROM net GROUP BY time(5m), *`,
+			want: `delta((last_over_time(net_bytes_recv[5m]))[5m:5m]) >= 0`,
+		},
+		{
+			sql:  `SELECT difference(bytes_recv) FROM net`,
+			want: `idelta(net_bytes_recv[1m])`,
+		},
+		{
+			sql:  `SELECT non_negative_difference(mean(bytes_recv)) * 8 FROM net GROUP BY time(1m)`,
+			want: `(delta((sum(sum_over_time(net_bytes_recv[1m])) / on() sum(count_over_time(net_bytes_recv[1m])))[1m:1m]) >= 0) * 8`,
+		},
+		{
+			sql:  `SELECT integral(power, 1h) FROM energy WHERE time > now() - 1d GROUP BY time(1d), host`,
+			want: `sum by(host) (integrate(energy_power[1d]) / 3600)`,
+		},
+		{
+			sql:  `SELECT integral(power) FROM energy GROUP BY *`,
+			want: `integrate(energy_power[1m])`,
+		},
+		{
+			sql:  `SELECT integral(power, 1ms) FROM energy`,
+			want: `sum(integrate(energy_power[1m]) * 1000)`,
+		},
+		{
+			sql:  `SELECT cumulative_sum(integral(power, 1h)) / 1000 FROM energy GROUP BY time(1h)`,
+			want: `running_sum(sum(integrate(energy_power[1h]) / 3600)) / 1000`,
+		},
+		{
+			sql:  `SELECT first(usage) FROM cpu GROUP BY host`,
+			want: `max by(host) (first_over_time(cpu_usage[1m]) and tfirst_over_time(cpu_usage[1m]) == on(host) group_left() min by(host) (tfirst_over_time(cpu_usage[1m])))`,
+		},
+		{
+			sql:  `SELECT first(usage) FROM cpu GROUP BY time(1m)`,
+			want: `max(first_over_time(cpu_usage[1m]) and tfirst_over_time(cpu_usage[1m]) == on() group_left() min(tfirst_over_time(cpu_usage[1m])))`,
+		},
+		{
+			sql:          `SELECT max(/^usage/) FROM cpu GROUP BY host`,
+			want:         `max_over_time({__name__=~"cpu_usage.*"}[1m])`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT first(usage) FROM cpu GROUP BY time(1m), *`,
+			want: `first_over_time(cpu_usage[1m])`,
+		},
+		{
+			sql:  `SELECT time AS ts, last(usage) FROM cpu GROUP BY time(5m), host`,
+			want: `union(label_set(max by(host) (tlast_over_time(cpu_usage[5m])), "__union_result__", "ts"), label_set(max by(host) (last_over_time(cpu_usage[5m]) and tlast_over_time(cpu_usage[5m]) == on(host) group_left() max by(host) (tlast_over_time(cpu_usage[5m]))), "__union_result__", "last_cpu_usage"))`,
+		},
+		{
+			sql:  `SELECT mean(usage) AS u, max(usage) FROM cpu`,
+			want: `union(label_set(sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])), "__union_result__", "u"), label_set(max(max_over_time(cpu_usage[1m])), "__union_result__", "max_cpu_usage"))`,
+		},
+		{
+			sql:  `SELECT time, max(usage) FROM cpu GROUP BY host`,
+			want: `union(label_set(min by(host) (tmax_over_time(cpu_usage[1m]) and max_over_time(cpu_usage[1m]) == on(host) group_left() max by(host) (max_over_time(cpu_usage[1m]))), "__union_result__", "time"), label_set(max by(host) (max_over_time(cpu_usage[1m])), "__union_result__", "max_cpu_usage"))`,
+		},
+		{
+			sql:          `SELECT time, mean(usage) FROM cpu`,
+			want:         `sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT DISTINCT status FROM http`,
+			want: `label_value(count by(__distinct_value__) (count_values_over_time("__distinct_value__", http_status[1m])), "__distinct_value__")`,
+		},
+		{
+			sql:  `SELECT distinct(status) FROM http GROUP BY time(5m), host`,
+			want: `label_value(count by(host, __distinct_value__) (count_values_over_time("__distinct_value__", http_status[5m])), "__distinct_value__")`,
+		},
+		{
+			sql:  `SELECT count(distinct(status)) FROM http GROUP BY time(5m), host`,
+			want: `count by(host) (count by(host, __distinct_value__) (count_values_over_time("__distinct_value__", http_status[5m])))`,
+		},
+		{
+			sql:  `SELECT count(DISTINCT status) FROM http GROUP BY time(5m), *`,
+			want: `distinct_over_time(http_status[5m])`,
+		},
+		{
+			sql:     `SELECT mean(distinct(status)) FROM http`,
+			wantErr: true,
+		},
+		{
+			sql:  `SELECT top(usage, 3) FROM cpu GROUP BY time(5m)`,
+			want: `topk_avg(3, max_over_time(cpu_usage[5m]))`,
+		},
+		{
+			sql:  `SELECT top(usage, host, 3) FROM cpu`,
+			opts: []Option{WithTopkFlavour(TOPK_FLAVOUR_NONE)},
+			want: `topk(3, max by(host) (max_over_time(cpu_usage[1m])))`,
+		},
+		{
+			sql:  `SELECT top(usage, 3) FROM cpu GROUP BY host`,
+			want: `topk_avg(3, max_over_time(cpu_usage[1m])) by(host)`,
+		},
+		{
+			sql:  `SELECT bottom(usage, 3) FROM cpu GROUP BY time(5m), host, cpu`,
+			want: `bottomk_avg(3, min_over_time(cpu_usage[5m])) by(host, cpu)`,
+		},
+		{
+			sql:  `SELECT top(usage, cpu, 3) FROM cpu GROUP BY host`,
+			want: `topk_avg(3, max by(host, cpu) (max_over_time(cpu_usage[1m]))) by(host)`,
+		},
+		{
+			sql:  `SELECT top(usage, 3) FROM cpu GROUP BY *`,
+			want: `topk_avg(3, max_over_time(cpu_usage[1m]))`,
+		},
+		{
+			sql:  `SELECT bottom(usage, 3) FROM cpu`,
+			opts: []Option{WithTopkFlavour(TOPK_FLAVOUR_LAST)},
+			want: `bottomk_last(3, min_over_time(cpu_usage[1m]))`,
+		},
+		{
+			sql:     `SELECT top(usage, 3) FROM cpu`,
+			opts:    []Option{WithTopkFlavour("first")},
+			wantErr: true,
+		},
+		{
+			sql:          `SELECT percentile(latency, 99.9) FROM http GROUP BY time(5m)`,
+			want:         `quantile(0.999, quantile_over_time(0.999, http_latency[5m]))`,
+			wantWarnings: 2,
+		},
+		{
+			sql:          `SELECT percentile(latency, 95) FROM http GROUP BY time(5m), host`,
+			want:         `quantile by(host) (0.95, quantile_over_time(0.95, http_latency[5m]))`,
+			wantWarnings: 2,
+		},
+		{
+			sql:          `SELECT percentile(latency, 95) FROM http GROUP BY *`,
+			want:         `quantile_over_time(0.95, http_latency[1m])`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT percentile(latency, 100) FROM http GROUP BY *`,
+			want: `quantile_over_time(1, http_latency[1m])`,
+		},
+		{
+			sql:  `SELECT percentile(latency, 0) FROM http GROUP BY *`,
+			want: `quantile_over_time(0, http_latency[1m])`,
+		},
+		{
+			sql:     `SELECT percentile(latency, 100.1) FROM http`,
+			wantErr: true,
+		},
+		{
+			sql:  `SELECT usage_idle FROM cpu WHERE usage_idle < 10 AND host = 'a'`,
+			want: `cpu_usage_idle{host="a"} < 10`,
+		},
+		{
+			sql:          `SELECT mean(usage_user) FROM cpu WHERE usage_idle < 10 AND host = 'a' GROUP BY time(5m), host`,
+			want:         `sum by(host) (sum_over_time((cpu_usage_user{host="a"} and cpu_usage_idle{host="a"} < 10)[5m:])) / on(host) sum by(host) (count_over_time((cpu_usage_user{host="a"} and cpu_usage_idle{host="a"} < 10)[5m:]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT max(usage_user) FROM cpu WHERE 10 > usage_idle AND (usage_user >= 1 AND host::tag = 'a')`,
+			want:         `max(max_over_time((cpu_usage_user{host="a"} >= 1 and cpu_usage_idle{host="a"} < 10)[1m:]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:     `SELECT mean(usage_user) FROM cpu WHERE usage_idle < 10 OR host = 'a'`,
+			wantErr: true,
+		},
+		{
+			sql:     `SELECT usage_user FROM cpu WHERE state::field = 'on'`,
+			wantErr: true,
+		},
+		{
+			sql:  `SELECT host, usage_user FROM cpu WHERE usage_idle < 10 AND cpu = 'cpu0'`,
+			opts: []Option{cpuSchema},
+			want: `cpu_usage_user{cpu="cpu0"} and cpu_usage_idle{cpu="cpu0"} < 10`,
+		},
+		{
+			sql:     `SELECT usage_user FROM cpu WHERE usage_idle = '10'`,
+			opts:    []Option{cpuSchema},
+			wantErr: true,
+		},
+		{
+			sql:     `SELECT usage_user FROM cpu WHERE cpu = 1`,
+			opts:    []Option{cpuSchema},
+			wantErr: true,
+		},
+		{
+			sql:     `SELECT mean(usage_user) FROM cpu GROUP BY usage_idle`,
+			opts:    []Option{cpuSchema},
+			wantErr: true,
+		},
+		{
+			sql:     `SELECT host FROM cpu`,
+			opts:    []Option{cpuSchema},
+			wantErr: true,
+		},
+		{
+			sql: `SELECT mean(usage_user) FROM cpu WHERE status = 1 GROUP BY status`,
+			opts: []Option{WithSchema(SchemaFunc(func(measurement string, key string) influxql.DataType {
+				if key == "status" {
+					return influxql.Tag
+				}
+				return influxql.Unknown
+			}))},
+			wantErr: true,
+		},
+		{
+			sql:  `SELECT usage_user FROM cpu WHERE x::field < 10 AND y::tag = '1'`,
+			want: `cpu_usage_user{y="1"} and cpu_x{y="1"} < 10`,
+		},
+		{
+			sql:  `SELECT free FROM disk WHERE (host = 'a' OR host = 'b') AND path = '/'`,
+			want: `disk_free{host="a",path="/" or host="b",path="/"}`,
+		},
+		{
+			sql:  `SELECT mean(free) FROM disk WHERE path = '/' AND (host = 'a' OR (host = 'b' AND region = 'x')) GROUP BY time(5m)`,
+			want: `sum(sum_over_time(disk_free{path="/",host="a" or path="/",host="b",region="x"}[5m])) / on() sum(count_over_time(disk_free{path="/",host="a" or path="/",host="b",region="x"}[5m]))`,
+		},
+		{
+			sql:  `SELECT mean(free), mean(used) FROM disk WHERE host = 'a' OR host = 'b'`,
+			want: `union(label_set(sum(sum_over_time(disk_free{host="a" or host="b"}[1m])) / on() sum(count_over_time(disk_free{host="a" or host="b"}[1m])), "__union_result__", "mean_disk_free"), label_set(sum(sum_over_time(disk_used{host="a" or host="b"}[1m])) / on() sum(count_over_time(disk_used{host="a" or host="b"}[1m])), "__union_result__", "mean_disk_used"))`,
+		},
+		{
+			sql:  `SELECT free FROM disk WHERE host = 'a,b' OR host = 'c'`,
+			want: `disk_free{host="a,b" or host="c"}`,
+		},
+		{
+			sql:  `SELECT usage_user FROM cpu WHERE (host = 'a' OR host = 'b') AND usage_idle < 10`,
+			want: `cpu_usage_user{host="a" or host="b"} and cpu_usage_idle{host="a" or host="b"} < 10`,
+		},
+		{
+			sql:          `SELECT elapsed(free, 1s) FROM disk WHERE host = 'a' OR host = 'b'`,
+			want:         `scrape_interval(disk_free{host="a" or host="b"}[1m])`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT free FROM disk WHERE host =~ /^web/ AND path !~ /tmp$/ AND region =~ /^us-west$/`,
+			want: `disk_free{host=~"web.*",path!~".*tmp",region=~"us-west"}`,
+		},
+		{
+			sql:  `SELECT free FROM disk WHERE host =~ /web|^db$/`,
+			want: `disk_free{host=~".*web.*|db"}`,
+		},
+		{
+			sql:  `SELECT /d(req|con)/ FROM haproxy`,
+			want: `{__name__=~"haproxy_.*d(req|con).*"}`,
+		},
+		{
+			sql:  `SELECT last(/^usage_user|^usage_system/) FROM /cpu/ GROUP BY *`,
+			want: `label_replace(last_over_time({__name__=~"(.*cpu.*)_(?:usage_user.*|usage_system.*)"}[1m]) keep_metric_names, "__measurement__", "$1", "__name__", "(.*cpu.*)_(?:usage_user.*|usage_system.*)")`,
+		},
+		{
+			sql:  `SELECT mean("usage-idle") FROM "vm.cpu" WHERE "host.name" = 'a' GROUP BY "zone-id"`,
+			want: `sum by(zone\-id) (sum_over_time({host\.name="a",__name__="vm.cpu_usage-idle"}[1m])) / on(zone\-id) sum by(zone\-id) (count_over_time({host\.name="a",__name__="vm.cpu_usage-idle"}[1m]))`,
 		},
 		{
-			sql:  `SELECT percentile("bps_recv", 95) FROM "vm_netio" WHERE "vm_id" = 'cdc9df53-7175-42b4-8ea9-04139d18825a' AND time > now() - 10080m GROUP BY time(7d)`,
-			want: `quantile_over_time(0.95, vm_netio_bps_recv{vm_id="cdc9df53-7175-42b4-8ea9-04139d18825a"}[1w])`,
+			sql:  `SELECT mean("usage-idle") FROM "vm.cpu" WHERE "host.name" = 'a' GROUP BY "zone-id"`,
+			opts: []Option{WithNameSanitizing(NAME_SANITIZING_PROMETHEUS)},
+			want: `sum by(zone_id) (sum_over_time(vm_cpu_usage_idle{host_name="a"}[1m])) / on(zone_id) sum by(zone_id) (count_over_time(vm_cpu_usage_idle{host_name="a"}[1m]))`,
+		},
+		{
+			sql:  `SELECT max("1st") FROM cpu GROUP BY "0"`,
+			opts: []Option{WithNameSanitizing(NAME_SANITIZING_PROMETHEUS)},
+			want: `max by(\0) (max_over_time(cpu_1st[1m]))`,
+		},
+		{
+			sql:  `SELECT "used-bytes" FROM "mem" WHERE "free.bytes" > 0`,
+			want: `{__name__="mem_used-bytes"} and {__name__="mem_free.bytes"} > 0`,
+		},
+		{
+			sql:     `SELECT mean(usage) FROM cpu`,
+			opts:    []Option{WithNameSanitizing("unknown")},
+			wantErr: true,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM "telegraf"."autogen"."cpu" WHERE host = 'a'`,
+			want: `sum(sum_over_time(cpu_usage{host="a",db="telegraf"}[1m])) / on() sum(count_over_time(cpu_usage{host="a",db="telegraf"}[1m]))`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu`,
+			opts: []Option{WithDatabase("telegraf")},
+			want: `sum(sum_over_time(cpu_usage{db="telegraf"}[1m])) / on() sum(count_over_time(cpu_usage{db="telegraf"}[1m]))`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM "collectd".."cpu"`,
+			opts: []Option{WithDatabase("telegraf"), WithDatabaseLabel("database")},
+			want: `sum(sum_over_time(cpu_usage{database="collectd"}[1m])) / on() sum(count_over_time(cpu_usage{database="collectd"}[1m]))`,
+		},
+		{
+			sql:  `SELECT last(*) FROM "telegraf"."1y"."cpu" GROUP BY *`,
+			opts: []Option{downsampledRetentionPolicy},
+			want: `last_over_time({db="telegraf",vm_account_id="1",__name__=~"downsampled_cpu_.*"}[1m])`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM "telegraf"."1y"."cpu" WHERE host = 'a' OR host = 'b' GROUP BY host`,
+			opts: []Option{downsampledRetentionPolicy},
+			want: `sum by(host) (sum_over_time(downsampled_cpu_usage{host="a",db="telegraf",vm_account_id="1" or host="b",db="telegraf",vm_account_id="1"}[1m])) / on(host) sum by(host) (count_over_time(downsampled_cpu_usage{host="a",db="telegraf",vm_account_id="1" or host="b",db="telegraf",vm_account_id="1"}[1m]))`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM "telegraf"."autogen"."cpu"`,
+			opts: []Option{downsampledRetentionPolicy},
+			want: `sum(sum_over_time(cpu_usage{db="telegraf"}[1m])) / on() sum(count_over_time(cpu_usage{db="telegraf"}[1m]))`,
+		},
+		{
+			sql:     `SELECT mean(usage) FROM "telegraf".."cpu", "collectd".."cpu"`,
+			wantErr: true,
+		},
+		{
+			sql:     `SELECT mean(usage) FROM "collectd".."cpu"`,
+			opts:    []Option{WithDatabaseLabel("bad-label")},
+			wantErr: true,
+		},
+		{
+			sql: `SELECT mean(usage) FROM "telegraf"."1y"."cpu"`,
+			opts: []Option{WithRetentionPolicyMapping(RetentionPolicyMappingFunc(func(database string, retentionPolicy string) (*RetentionPolicy, error) {
+				return &RetentionPolicy{Labels: map[string]string{"bad-label": "d"}}, nil
+			}))},
+			wantErr: true,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY time(1h, 15m), host`,
+			want: `sum by(host) (sum_over_time(cpu_usage[1h] offset -15m)) / on(host) sum by(host) (count_over_time(cpu_usage[1h] offset -15m))`,
+		},
+		{
+			sql:  `SELECT max(usage) FROM cpu WHERE host = 'a' OR host = 'b' GROUP BY time(1d, -8h)`,
+			want: `max(max_over_time(cpu_usage{host="a" or host="b"}[1d] offset -16h))`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY time(1h, 1h)`,
+			want: `sum(sum_over_time(cpu_usage[1h])) / on() sum(count_over_time(cpu_usage[1h]))`,
+		},
+		{
+			sql:          `SELECT mean(usage_user) FROM cpu WHERE usage_idle < 10 GROUP BY time(1h, 15m)`,
+			want:         `sum(sum_over_time((cpu_usage_user offset -15m and cpu_usage_idle offset -15m < 10)[1h:])) / on() sum(count_over_time((cpu_usage_user offset -15m and cpu_usage_idle offset -15m < 10)[1h:]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY time(5m), host fill(0)`,
+			want: `sum by(host) (sum_over_time(cpu_usage[5m])) / on(host) sum by(host) (count_over_time(cpu_usage[5m])) default 0`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY time(5m) fill(-1.5)`,
+			want: `sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m])) default -1.5`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY time(5m) fill(previous)`,
+			want: `keep_last_value(sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m])))`,
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu GROUP BY time(5m) fill(linear)`,
+			want:         `interpolate(sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m])))`,
+			wantMetadata: &Metadata{GroupByInterval: 5 * time.Minute, Fill: influxql.LinearFill},
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY time(5m) fill(none)`,
+			want: `sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m]))`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY time(5m) fill(null)`,
+			want: `sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m]))`,
+		},
+		{
+			sql:  `SELECT mean(used) / mean(total) FROM mem GROUP BY time(5m) fill(0)`,
+			want: `(sum(sum_over_time(mem_used[5m])) / on() sum(count_over_time(mem_used[5m]))) / on() (sum(sum_over_time(mem_total[5m])) / on() sum(count_over_time(mem_total[5m]))) default 0`,
+		},
+		{
+			sql:  `SELECT time, max(usage) FROM cpu GROUP BY time(5m) fill(previous)`,
+			want: `union(label_set(min(tmax_over_time(cpu_usage[5m]) and max_over_time(cpu_usage[5m]) == on() group_left() max(max_over_time(cpu_usage[5m]))), "__union_result__", "time"), label_set(keep_last_value(max(max_over_time(cpu_usage[5m]))), "__union_result__", "max_cpu_usage"))`,
+		},
+		{
+			sql:  `SELECT max(usage) FROM cpu fill(0)`,
+			want: `max(max_over_time(cpu_usage[1m]))`,
+		},
+		{
+			sql:          `SELECT median(usage) FROM cpu GROUP BY time(5m), host`,
+			want:         `quantile by(host) (0.5, median_over_time(cpu_usage[5m]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT mode(status) FROM http GROUP BY time(5m), host`,
+			want:         `mode by(host) (mode_over_time(http_status[5m]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT mode(status) FROM http`,
+			want:         `mode(mode_over_time(http_status[1m]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT stddev(usage) FROM cpu GROUP BY time(5m), host`,
+			want:         `avg by(host) (stddev_over_time(cpu_usage[5m]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT max(bytes), min(bytes) FROM net_eth0, net_eth1`,
+			want: `union(label_set(max by(__measurement__) (label_replace(max_over_time({__name__=~"(net_eth0|net_eth1)_bytes"}[1m]) keep_metric_names, "__measurement__", "$1", "__name__", "(net_eth0|net_eth1)_bytes")), "__union_result__", "max_net_eth0_net_eth1_bytes"), label_set(min by(__measurement__) (label_replace(min_over_time({__name__=~"(net_eth0|net_eth1)_bytes"}[1m]) keep_metric_names, "__measurement__", "$1", "__name__", "(net_eth0|net_eth1)_bytes")), "__union_result__", "min_net_eth0_net_eth1_bytes"))`,
+		},
+		{
+			sql:          `SELECT last(/^usage/), max(free) FROM disk`,
+			want:         `union(label_set(last_over_time({__name__=~"disk_usage.*"}[1m]), "__union_result__", "last_disk_^usage"), label_set(max(max_over_time(disk_free[1m])), "__union_result__", "max_disk_free"))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT last(/^usage/) AS usage, max(free) FROM disk`,
+			want:         `union(label_set(last_over_time({__name__=~"disk_usage.*"}[1m]), "__union_result__", "usage"), label_set(max(max_over_time(disk_free[1m])), "__union_result__", "max_disk_free"))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT max(bytes), min(bytes) FROM /^disk.*/`,
+			want: `union(label_set(max by(__measurement__) (label_replace(max_over_time({__name__=~"(disk.*)_bytes"}[1m]) keep_metric_names, "__measurement__", "$1", "__name__", "(disk.*)_bytes")), "__union_result__", "max_^disk.*_bytes"), label_set(min by(__measurement__) (label_replace(min_over_time({__name__=~"(disk.*)_bytes"}[1m]) keep_metric_names, "__measurement__", "$1", "__name__", "(disk.*)_bytes")), "__union_result__", "min_^disk.*_bytes"))`,
+		},
+		{
+			sql:          `SELECT holt_winters(mean(usage), 5, 0) FROM cpu WHERE time >= 1698163200000ms AND time <= 1698166800000ms GROUP BY time(1m)`,
+			want:         `holt_winters((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[10m:1m], 0.5, 0.5)`,
+			wantWarnings: 2,
+			wantRange: &influxql.TimeRange{
+				Min: time.Unix(1698163200, 0).UTC(),
+				Max: time.Unix(1698166800, 0).UTC().Add(5 * time.Minute),
+			},
+		},
+		{
+			sql:          `SELECT holt_winters_with_fit(max(usage), 20, 12) FROM cpu WHERE time >= 1698163200000ms AND time <= 1698166800000ms GROUP BY time(1m), host`,
+			want:         `holt_winters((max by(host) (max_over_time(cpu_usage[1m])))[24m:1m], 0.5, 0.5)`,
+			wantWarnings: 3,
+			wantRange: &influxql.TimeRange{
+				Min: time.Unix(1698163200, 0).UTC(),
+				Max: time.Unix(1698166800, 0).UTC().Add(20 * time.Minute),
+			},
+		},
+		{
+			sql:          `SELECT max(hw) FROM (SELECT holt_winters(mean(usage), 5, 0) AS hw FROM cpu WHERE time >= 1698163200000ms AND time <= 1698166800000ms GROUP BY time(1m)) GROUP BY time(10m)`,
+			want:         `max(max_over_time((holt_winters((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[10m:1m], 0.5, 0.5))[10m:1m]))`,
+			wantWarnings: 2,
+			wantRange: &influxql.TimeRange{
+				Min: time.Unix(1698163200, 0).UTC(),
+				Max: time.Unix(1698166800, 0).UTC().Add(5 * time.Minute),
+			},
+		},
+		{
+			sql:  `SELECT exponential_moving_average(mean(usage), 3) FROM cpu WHERE time >= 1698163200000ms AND time <= 1698166800000ms GROUP BY time(1m), host`,
+			want: `smooth_exponential(sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])), 0.5) and on() vector(time()) >= 1.69816332e+09`,
+		},
+		{
+			sql:          `SELECT exponential_moving_average(mean(usage), 5) FROM cpu GROUP BY time(1m)`,
+			want:         `smooth_exponential(sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])), 0.3333333333333333)`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT exponential_moving_average(mean(usage), 3, 0, 'simple') FROM cpu GROUP BY time(1m)`,
+			want:         `smooth_exponential(sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])), 0.5)`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT double_exponential_moving_average(mean(usage), 3, 0) FROM cpu GROUP BY time(1m), host`,
+			want: `2 * smooth_exponential(sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])), 0.5) - on(host) smooth_exponential(smooth_exponential(sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])), 0.5), 0.5)`,
+		},
+		{
+			sql:  `SELECT triple_exponential_moving_average(mean(usage), 3, 0) FROM cpu GROUP BY time(1m)`,
+			want: `3 * smooth_exponential(sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])), 0.5) - on() 3 * smooth_exponential(smooth_exponential(sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])), 0.5), 0.5) + on() smooth_exponential(smooth_exponential(smooth_exponential(sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])), 0.5), 0.5), 0.5)`,
+		},
+		{
+			sql:  `SELECT relative_strength_index(mean(usage), 4, 0) FROM cpu GROUP BY time(1m)`,
+			want: `100 * smooth_exponential(clamp_min(delta((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[1m:1m]), 0), 0.25) / on() (smooth_exponential(clamp_min(delta((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[1m:1m]), 0), 0.25) + on() smooth_exponential(-clamp_max(delta((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[1m:1m]), 0), 0.25))`,
+		},
+		{
+			sql:  `SELECT chande_momentum_oscillator(mean(usage), 10, 0) FROM cpu GROUP BY time(1m)`,
+			want: `100 * (sum_over_time((clamp_min(delta((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[1m:1m]), 0))[10m:1m]) - on() sum_over_time((-clamp_max(delta((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[1m:1m]), 0))[10m:1m])) / on() (sum_over_time((clamp_min(delta((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[1m:1m]), 0))[10m:1m]) + on() sum_over_time((-clamp_max(delta((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[1m:1m]), 0))[10m:1m]))`,
+		},
+		{
+			sql:          `SELECT kaufmans_efficiency_ratio(usage, 10, 0) FROM cpu`,
+			want:         `abs(delta((cpu_usage)[10m:1m])) / ignoring(__name__) sum_over_time((abs(delta((cpu_usage)[1m:1m])))[10m:1m])`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT exponential_moving_average(usage, 3) FROM cpu`,
+			want:         `smooth_exponential(cpu_usage, 0.5)`,
+			wantWarnings: 2,
+		},
+		{
+			sql:          `SELECT kaufmans_adaptive_moving_average(mean(usage), 10, 0) FROM cpu GROUP BY time(5m)`,
+			want:         `smooth_exponential(sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m])), 0.18181818181818182)`,
+			wantWarnings: 1,
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu GROUP BY time(1h, 15m)`,
+			want:         `sum(sum_over_time(cpu_usage[1h] offset -15m)) / on() sum(count_over_time(cpu_usage[1h] offset -15m))`,
+			wantMetadata: &Metadata{GroupByInterval: time.Hour, GroupByOffset: 15 * time.Minute},
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu GROUP BY time(1d, -8h)`,
+			want:         `sum(sum_over_time(cpu_usage[1d] offset -16h)) / on() sum(count_over_time(cpu_usage[1d] offset -16h))`,
+			wantMetadata: &Metadata{GroupByInterval: 24 * time.Hour, GroupByOffset: 16 * time.Hour},
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu GROUP BY time(5m, now())`,
+			want:         `sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m]))`,
+			wantWarnings: 1,
+			wantMetadata: &Metadata{GroupByInterval: 5 * time.Minute},
+		},
+		{
+			sql:     `SELECT mean(usage) FROM cpu GROUP BY time()`,
+			wantErr: true,
+		},
+		{
+			sql:     `SELECT mean(usage) FROM cpu GROUP BY time(1m, 1s, 2s)`,
+			wantErr: true,
+		},
+		{
+			sql:          `SELECT max(m) FROM (SELECT mean(usage) AS m FROM cpu GROUP BY time(1m, 30s)) GROUP BY time(1h, 15m)`,
+			want:         `max(max_over_time((sum(sum_over_time(cpu_usage[1m] offset -30s)) / on() sum(count_over_time(cpu_usage[1m] offset -30s)))[1h:1m]))`,
+			wantWarnings: 1,
+			wantMetadata: &Metadata{GroupByInterval: time.Hour, GroupByOffset: 15 * time.Minute},
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu`,
+			want:         `sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m]))`,
+			wantMetadata: &Metadata{},
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu GROUP BY time(5m) fill(100)`,
+			want:         `sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m])) default 100`,
+			wantMetadata: &Metadata{GroupByInterval: 5 * time.Minute, Fill: influxql.NumberFill, FillValue: 100},
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu GROUP BY time(5m)`,
+			want:         `sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m]))`,
+			wantMetadata: &Metadata{GroupByInterval: 5 * time.Minute, Fill: influxql.NullFill},
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu fill(previous)`,
+			want:         `sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m]))`,
+			wantMetadata: &Metadata{Fill: influxql.NullFill},
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY host`,
+			opts: []Option{WithNamingStrategy(&InfluxNaming{Separator: "."}), WithNameSanitizing(NAME_SANITIZING_PROMETHEUS)},
+			want: `sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m]))`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY host`,
+			opts: []Option{WithNamingStrategy(&InfluxNaming{Separator: "."})},
+			want: `sum by(host) (sum_over_time({__name__="cpu.usage"}[1m])) / on(host) sum by(host) (count_over_time({__name__="cpu.usage"}[1m]))`,
+		},
+		{
+			sql:  `SELECT last(*) FROM cpu GROUP BY *`,
+			opts: []Option{WithNamingStrategy(&InfluxNaming{Separator: ":"})},
+			want: `last_over_time({__name__=~"cpu:.*"}[1m])`,
+		},
+		{
+			sql:  `SELECT mean(value) FROM temperature`,
+			opts: []Option{WithNamingStrategy(&InfluxNaming{Separator: "_", SingleFieldName: "value"})},
+			want: `sum(sum_over_time(temperature[1m])) / on() sum(count_over_time(temperature[1m]))`,
+		},
+		{
+			sql:  `SELECT last(*) FROM temperature GROUP BY *`,
+			opts: []Option{WithNamingStrategy(&InfluxNaming{Separator: "_", SingleFieldName: "value"})},
+			want: `last_over_time({__name__=~"temperature(?:_.*)?"}[1m])`,
+		},
+		{
+			sql:  `SELECT mean(bytes) FROM net_eth0, net_eth1 GROUP BY host`,
+			opts: []Option{WithNamingStrategy(&InfluxNaming{MeasurementLabel: "measurement"})},
+			want: `sum by(host, measurement) (sum_over_time(bytes{measurement=~"(net_eth0|net_eth1)"}[1m])) / on(host, measurement) sum by(host, measurement) (count_over_time(bytes{measurement=~"(net_eth0|net_eth1)"}[1m]))`,
+		},
+		{
+			sql:  `SELECT last(/^usage/) FROM cpu WHERE host = 'a' GROUP BY *`,
+			opts: []Option{WithNamingStrategy(&InfluxNaming{MeasurementLabel: "measurement"})},
+			want: `last_over_time({host="a",measurement="cpu",__name__=~"usage.*"}[1m])`,
+		},
+		{
+			sql:          `SELECT mean(usage) FROM cpu`,
+			opts:         []Option{WithNamingStrategy(&InfluxNaming{SkipMeasurement: true})},
+			want:         `sum(sum_over_time(usage[1m])) / on() sum(count_over_time(usage[1m]))`,
+			wantWarnings: 1,
+		},
+		{
+			sql:  `SELECT max(m) FROM (SELECT mean(usage) AS m FROM cpu GROUP BY time(1m), host) GROUP BY time(1h)`,
+			want: `max(max_over_time((sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])))[1h:1m]))`,
+		},
+		{
+			sql:  `SELECT max("mean") FROM (SELECT mean(usage) FROM cpu WHERE region = 'us' GROUP BY time(1m), host) WHERE time > now() - 1d GROUP BY time(1h), host`,
+			want: `max by(host) (max_over_time((sum by(host) (sum_over_time(cpu_usage{region="us"}[1m])) / on(host) sum by(host) (count_over_time(cpu_usage{region="us"}[1m])))[1h:1m]))`,
+		},
+		{
+			sql:  `SELECT m FROM (SELECT mean(usage) AS m FROM cpu GROUP BY time(5m))`,
+			want: `sum(sum_over_time(cpu_usage[5m])) / on() sum(count_over_time(cpu_usage[5m]))`,
+		},
+		{
+			sql:  `SELECT sum(m) FROM (SELECT max(m) AS m FROM (SELECT mean(usage) AS m FROM cpu GROUP BY time(1m), host) GROUP BY time(10m), host) GROUP BY time(1h)`,
+			want: `sum(sum_over_time((max by(host) (max_over_time((sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])))[10m:1m])))[1h:10m]))`,
+		},
+		{
+			sql:  `SELECT m / n FROM (SELECT mean(a) AS m, mean(b) AS n FROM x GROUP BY time(1m))`,
+			want: `(sum(sum_over_time(x_a[1m])) / on() sum(count_over_time(x_a[1m]))) / on() (sum(sum_over_time(x_b[1m])) / on() sum(count_over_time(x_b[1m])))`,
+		},
+		{
+			sql:  `SELECT max(m) * 2 FROM (SELECT mean(usage) AS m FROM cpu GROUP BY time(1m), host) GROUP BY time(1h)`,
+			want: `max(max_over_time((sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])))[1h:1m])) * 2`,
+		},
+		{
+			sql:  `SELECT max(m) / min(m), mean(m) FROM (SELECT mean(usage) AS m FROM cpu GROUP BY time(1m), host) GROUP BY time(1h), host`,
+			want: `union(label_set(max by(host) (max_over_time((sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])))[1h:1m])) / on(host) min by(host) (min_over_time((sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])))[1h:1m])), "__union_result__", "max_min"), label_set(sum by(host) (sum_over_time((sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])))[1h:1m])) / on(host) sum by(host) (count_over_time((sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m])))[1h:1m])), "__union_result__", "mean_cpu_usage"))`,
+		},
+		{
+			sql:     `SELECT max(unknown) FROM (SELECT mean(usage) AS m FROM cpu GROUP BY time(1m)) GROUP BY time(1h)`,
+			wantErr: true,
+		},
+		{
+			sql:  `SELECT top("usage_active", "vm_name", "vm_id", 5) FROM "vm_cpu" WHERE ("project_domain" != '' OR "project_tags.0.0.key" = 'user:L2.1')`,
+			want: `topk_avg(5, max by(vm_name, vm_id) (max_over_time(vm_cpu_usage_active{project_domain!="" or project_tags\.0\.0\.key="user:L2.1"}[1m])))`,
 		},
-		//{
-		//	sql:  `SELECT top("usage_active", "vm_name", "vm_id", 5) FROM "vm_cpu" WHERE ("project_domain" != '' OR "project_tags.0.0.key" = 'user:L2.1')`,
-		//	want: `topk_avg(5, vm_cpu_usage_active{project_domain!="",project_tags.0.0.key="user:L2.1"}[1m])`,
-		//},
 	}
 	for _, tt := range tests {
 		t.Run(tt.sql, func(t *testing.T) {
-			m := NewPromQL()
+			m := NewPromQL(tt.opts...)
 			s, err := influxql.ParseStatement(tt.sql)
 			if err != nil {
 				t.Errorf("ParseStatement(%q) error = %v", tt.sql, err)
@@ -238,10 +1088,131 @@ func Test_metricsQL_Translate(t *testing.T) {
 			if got != tt.want {
 				t.Errorf("Translate() got = %v, want %v", got, tt.want)
 			}
+			metadata := m.GetMetadata()
+			if len(metadata.Warnings) != tt.wantWarnings {
+				t.Errorf("GetMetadata().Warnings = %v, want %d warnings", metadata.Warnings, tt.wantWarnings)
+			}
+			if tt.wantRange != nil {
+				if tr := m.GetTimeRange(); !tr.Min.Equal(tt.wantRange.Min) || !tr.Max.Equal(tt.wantRange.Max) {
+					t.Errorf("GetTimeRange() = %v, want %v", tr, tt.wantRange)
+				}
+			}
+			if want := tt.wantMetadata; want != nil {
+				if metadata.GroupByInterval != want.GroupByInterval || metadata.GroupByOffset != want.GroupByOffset {
+					t.Errorf("GetMetadata() interval = %v, offset = %v, want %v, %v", metadata.GroupByInterval, metadata.GroupByOffset, want.GroupByInterval, want.GroupByOffset)
+				}
+				if metadata.Fill != want.Fill || metadata.FillValue != want.FillValue {
+					t.Errorf("GetMetadata() fill = %v, value = %v, want %v, %v", metadata.Fill, metadata.FillValue, want.Fill, want.FillValue)
+				}
+			}
 		})
 	}
 }
 
+func Test_promQL_NameMapping(t *testing.T) {
+	tests := []struct {
+		sql  string
+		opts []Option
+		want map[string]string
+	}{
+		{
+			sql:  `SELECT mean(usage) FROM cpu WHERE "project_tags.0.0.key" = 'a'`,
+			want: map[string]string{"project_tags.0.0.key": `project_tags\.0\.0\.key`},
+		},
+		{
+			sql:  `SELECT mean("usage-idle") FROM "vm.cpu" GROUP BY "zone-id"`,
+			opts: []Option{WithNameSanitizing(NAME_SANITIZING_PROMETHEUS)},
+			want: map[string]string{
+				"vm.cpu_usage-idle": "vm_cpu_usage_idle",
+				"zone-id":           "zone_id",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			m := NewPromQL(tt.opts...)
+			s, err := influxql.ParseStatement(tt.sql)
+			if err != nil {
+				t.Fatalf("ParseStatement(%q) error = %v", tt.sql, err)
+			}
+			if _, err := m.Translate(s); err != nil {
+				t.Fatalf("Translate() error = %v", err)
+			}
+			if got := m.GetMetadata().NameMapping; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetMetadata().NameMapping = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_promQL_TranslateReused(t *testing.T) {
+	m := NewPromQL()
+	for _, tt := range []struct {
+		sql       string
+		want      string
+		wantRange *influxql.TimeRange
+	}{
+		{
+			sql:  `SELECT holt_winters(mean(usage), 5, 0) FROM cpu WHERE time >= 1698163200000ms AND time <= 1698166800000ms GROUP BY time(1m)`,
+			want: `holt_winters((sum(sum_over_time(cpu_usage[1m])) / on() sum(count_over_time(cpu_usage[1m])))[10m:1m], 0.5, 0.5)`,
+			wantRange: &influxql.TimeRange{
+				Min: time.Unix(1698163200, 0).UTC(),
+				Max: time.Unix(1698166800, 0).UTC().Add(5 * time.Minute),
+			},
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu WHERE time >= 1698163200000ms AND time <= 1698166800000ms GROUP BY host`,
+			want: `sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m]))`,
+			wantRange: &influxql.TimeRange{
+				Min: time.Unix(1698163200, 0).UTC(),
+				Max: time.Unix(1698166800, 0).UTC(),
+			},
+		},
+		{
+			sql:  `SELECT last(*) FROM cpu GROUP BY *`,
+			want: `last_over_time({__name__=~"cpu_.*"}[1m])`,
+		},
+		{
+			sql:  `SELECT mean(usage) FROM cpu GROUP BY host`,
+			want: `sum by(host) (sum_over_time(cpu_usage[1m])) / on(host) sum by(host) (count_over_time(cpu_usage[1m]))`,
+		},
+	} {
+		s, err := influxql.ParseStatement(tt.sql)
+		if err != nil {
+			t.Fatalf("ParseStatement(%q) error = %v", tt.sql, err)
+		}
+		got, err := m.Translate(s)
+		if err != nil {
+			t.Fatalf("Translate(%q) error = %v", tt.sql, err)
+		}
+		if got != tt.want {
+			t.Errorf("Translate(%q) got = %v, want %v", tt.sql, got, tt.want)
+		}
+		if tr := m.GetTimeRange(); !reflect.DeepEqual(tr, tt.wantRange) {
+			t.Errorf("Translate(%q) GetTimeRange() = %v, want %v", tt.sql, tr, tt.wantRange)
+		}
+	}
+}
+
+func TestNewStaticSchemaFromJSON(t *testing.T) {
+	schema, err := NewStaticSchemaFromJSON(strings.NewReader(`{"cpu": {"tags": ["host"], "fields": ["usage_idle"]}}`))
+	if err != nil {
+		t.Fatalf("NewStaticSchemaFromJSON() error = %v", err)
+	}
+	for key, want := range map[string]influxql.DataType{
+		"host":       influxql.Tag,
+		"usage_idle": influxql.AnyField,
+		"unknown":    influxql.Unknown,
+	} {
+		if got := schema.GetKeyType("cpu", key); got != want {
+			t.Errorf("GetKeyType(%q) = %v, want %v", key, got, want)
+		}
+	}
+	if got := schema.GetKeyType("mem", "host"); got != influxql.Unknown {
+		t.Errorf("GetKeyType of unknown measurement = %v, want %v", got, influxql.Unknown)
+	}
+}
+
 func Test_getTimeRange(t *testing.T) {
 	start, _ := time.Parse(time.RFC3339, "2023-10-24T16:00:00Z")
 	end, _ := time.Parse(time.RFC3339, "2023-10-26T15:59:59Z")
@@ -0,0 +1,92 @@
+package translator
+
+import (
+	"regexp"
+	"strings"
+)
+
+// regexFlagsPattern matches the leading flags of a regex, e.g. (?i)
+var regexFlagsPattern = regexp.MustCompile(`^\(\?[a-zA-Z]+\)`)
+
+// unanchorRegex translates the InfluxQL regex, which matches anywhere in the
+// value, into the fully anchored regex of PromQL matchers. The unanchored
+// sides of each alternative are padded with .*, while the ^ and $ anchors are
+// redundant and stripped, e.g. web|^db$ => .*web.*|db.
+func unanchorRegex(pattern string) string {
+	alternatives := splitRegexAlternatives(pattern)
+	for i, alt := range alternatives {
+		flags := regexFlagsPattern.FindString(alt)
+		alt = strings.TrimPrefix(alt, flags)
+		if strings.HasPrefix(alt, "^") {
+			alt = alt[1:]
+		} else if !strings.HasPrefix(alt, ".*") {
+			alt = ".*" + alt
+		}
+		if isAnchoredEnd(alt) {
+			alt = alt[:len(alt)-1]
+		} else if !strings.HasSuffix(alt, ".*") || isEscapedAt(alt, len(alt)-2) {
+			alt = alt + ".*"
+		}
+		if alt == ".*.*" {
+			alt = ".*"
+		}
+		alternatives[i] = flags + alt
+	}
+	return strings.Join(alternatives, "|")
+}
+
+// hasRegexAlternatives reports whether the regex has alternatives out of groups, e.g. a|b.
+func hasRegexAlternatives(pattern string) bool {
+	return len(splitRegexAlternatives(pattern)) > 1
+}
+
+// splitRegexAlternatives splits the regex by the | out of groups and character classes.
+func splitRegexAlternatives(pattern string) []string {
+	var (
+		result  []string
+		depth   int
+		inClass bool
+		start   int
+	)
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+			// a leading ] is a literal in the character class, e.g. []a]
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '|' && depth == 0:
+			result = append(result, pattern[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, pattern[start:])
+}
+
+// isAnchoredEnd reports whether the regex ends with an unescaped $.
+func isAnchoredEnd(pattern string) bool {
+	return strings.HasSuffix(pattern, "$") && !isEscapedAt(pattern, len(pattern)-1)
+}
+
+// isEscapedAt reports whether the character at index i is escaped by backslashes.
+func isEscapedAt(pattern string, i int) bool {
+	escaped := false
+	for j := i - 1; j >= 0 && pattern[j] == '\\'; j-- {
+		escaped = !escaped
+	}
+	return escaped
+}
@@ -0,0 +1,107 @@
+package translator
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/influxdata/influxql"
+	"github.com/pkg/errors"
+)
+
+// Schema tells whether the keys of measurements are tags or fields.
+type Schema interface {
+	// GetKeyType returns influxql.Tag for tag keys, influxql.AnyField or the
+	// field data type for field keys, and influxql.Unknown for unknown keys.
+	GetKeyType(measurement string, key string) influxql.DataType
+}
+
+// SchemaFunc is an adapter to use ordinary functions as Schema.
+type SchemaFunc func(measurement string, key string) influxql.DataType
+
+func (f SchemaFunc) GetKeyType(measurement string, key string) influxql.DataType {
+	return f(measurement, key)
+}
+
+// MeasurementSchema lists the tag and field keys of a measurement.
+type MeasurementSchema struct {
+	Tags   []string `json:"tags"`
+	Fields []string `json:"fields"`
+}
+
+// StaticSchema is the Schema of the measurements keyed by their names, e.g.
+// {"cpu": {"tags": ["host"], "fields": ["usage_idle", "usage_user"]}}.
+type StaticSchema map[string]*MeasurementSchema
+
+func (s StaticSchema) GetKeyType(measurement string, key string) influxql.DataType {
+	ms, ok := s[measurement]
+	if !ok || ms == nil {
+		return influxql.Unknown
+	}
+	for _, tag := range ms.Tags {
+		if tag == key {
+			return influxql.Tag
+		}
+	}
+	for _, field := range ms.Fields {
+		if field == key {
+			return influxql.AnyField
+		}
+	}
+	return influxql.Unknown
+}
+
+// NewStaticSchemaFromJSON decodes the StaticSchema from JSON.
+func NewStaticSchemaFromJSON(r io.Reader) (StaticSchema, error) {
+	schema := StaticSchema{}
+	if err := json.NewDecoder(r).Decode(&schema); err != nil {
+		return nil, errors.Wrap(err, "decode schema")
+	}
+	return schema, nil
+}
+
+// LoadSchemaFile loads the StaticSchema from a JSON file.
+func LoadSchemaFile(path string) (StaticSchema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open schema file %q", path)
+	}
+	defer f.Close()
+	return NewStaticSchemaFromJSON(f)
+}
+
+func isFieldType(typ influxql.DataType) bool {
+	switch typ {
+	case influxql.Float, influxql.Integer, influxql.String, influxql.Boolean, influxql.Unsigned, influxql.AnyField:
+		return true
+	}
+	return false
+}
+
+// getKeyType returns the type of the key referred by the query, the ::tag and
+// ::field casts take precedence over the schema of the measurements.
+func (m promQL) getKeyType(ref *influxql.VarRef) influxql.DataType {
+	if ref.Type == influxql.Tag || isFieldType(ref.Type) {
+		return ref.Type
+	}
+	if m.opts.schema == nil {
+		return influxql.Unknown
+	}
+	for _, src := range m.sources {
+		measurement, ok := src.(*influxql.Measurement)
+		if !ok || measurement.Regex != nil {
+			continue
+		}
+		if typ := m.opts.schema.GetKeyType(measurement.Name, ref.Val); typ != influxql.Unknown {
+			return typ
+		}
+	}
+	return influxql.Unknown
+}
+
+// isTagField reports whether the selected field is a tag, e.g. SELECT host, usage FROM cpu.
+// The tags are already the labels of the series.
+func (m promQL) isTagField(field *influxql.Field) bool {
+	ref, ok := field.Expr.(*influxql.VarRef)
+	return ok && m.getKeyType(ref) == influxql.Tag
+}
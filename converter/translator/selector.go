@@ -0,0 +1,171 @@
+package translator
+
+import (
+	"github.com/influxdata/influxql"
+	"github.com/influxdata/promql/v2"
+	"github.com/pkg/errors"
+)
+
+const TIME_FIELD_NAME = "time"
+
+// SELECTOR_FUNCTIONS are the InfluxQL selectors returning a point of the
+// series, which carries its own timestamp,
+// https://docs.influxdata.com/influxdb/v1/query_language/functions/#selectors
+var SELECTOR_FUNCTIONS Functions = []string{CALL_FIRST, CALL_LAST, CALL_MAX, CALL_MIN}
+
+// selectorTimestampFunctions maps the selector rollups to the MetricsQL rollups
+// returning the timestamp of the selected point, e.g.
+// https://docs.victoriametrics.com/MetricsQL.html#tmax_over_time
+var selectorTimestampFunctions = map[string]string{
+	"first_over_time": "tfirst_over_time",
+	"last_over_time":  "tlast_over_time",
+	"max_over_time":   "tmax_over_time",
+	"min_over_time":   "tmin_over_time",
+}
+
+func isTimeField(field *influxql.Field) bool {
+	ref, ok := field.Expr.(*influxql.VarRef)
+	return ok && ref.Val == TIME_FIELD_NAME
+}
+
+// splitTimeFields splits the `time` fields, e.g. SELECT time, max(usage), from the other fields.
+func splitTimeFields(fields influxql.Fields) (influxql.Fields, influxql.Fields) {
+	timeFields := make(influxql.Fields, 0)
+	restFields := make(influxql.Fields, 0, len(fields))
+	for _, field := range fields {
+		if isTimeField(field) {
+			timeFields = append(timeFields, field)
+		} else {
+			restFields = append(restFields, field)
+		}
+	}
+	return timeFields, restFields
+}
+
+// translateTimeField translates the `time` field selected along with a single
+// selector into the timestamp of the selected point, e.g.
+// SELECT time, max(usage) FROM cpu => tmax_over_time(cpu_usage[1m]).
+// The time of other queries is the timestamp of the result points, so nil is returned.
+func (m *promQL) translateTimeField(fields influxql.Fields, exprs []*fieldResult) (*fieldResult, error) {
+	if len(fields) == 0 {
+		return nil, errors.Errorf("at least 1 non-time field must be queried")
+	}
+	call, ok := fields[0].Expr.(*influxql.Call)
+	if len(fields) != 1 || !ok || !SELECTOR_FUNCTIONS.Has(call.Name) || len(exprs[0].aggrOps) != 1 {
+		m.metadata.addWarning("%s field is only translated along with a single selector, use the timestamps of the results instead", TIME_FIELD_NAME)
+		return nil, nil
+	}
+	timestamp, err := newSelectorTimestampExpr(exprs[0].expr)
+	if err != nil {
+		return nil, err
+	}
+	return newFieldResult(TIME_FIELD_NAME, nil, timestamp), nil
+}
+
+// newSelectorTimestampExpr replaces the selector rollup of expr by the rollup
+// returning the timestamp of the selected point. When the series of a group
+// are merged, only the timestamps of the series holding the selected value are kept, e.g.
+// min by(host) (tmax_over_time(cpu_usage[1m]) and max_over_time(cpu_usage[1m]) == on(host) group_left() max by(host) (max_over_time(cpu_usage[1m]))).
+func newSelectorTimestampExpr(expr promql.Expr) (promql.Expr, error) {
+	switch e := expr.(type) {
+	case *promql.AggregateExpr:
+		if and, ok := e.Expr.(*promql.BinaryExpr); ok && and.Op == promql.ItemLAND {
+			// the first or last point of the group is selected by its timestamp,
+			// see newCrossSeriesSelectorExpr
+			selected, ok := and.RHS.(*promql.BinaryExpr)
+			if !ok {
+				return nil, errors.Errorf("unexpected selected points %s of %s", and.RHS, e)
+			}
+			return selected.RHS, nil
+		}
+		timestamp, err := newSelectorTimestampExpr(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		selected := &promql.BinaryExpr{
+			Op:  promql.ItemEQL,
+			LHS: e.Expr,
+			RHS: e,
+			VectorMatching: &promql.VectorMatching{
+				Card:           promql.CardManyToOne,
+				MatchingLabels: e.Grouping,
+				On:             true,
+			},
+		}
+		return &promql.AggregateExpr{
+			// the earliest point is selected between equal values
+			Op: promql.ItemMin,
+			Expr: &promql.BinaryExpr{
+				Op:             promql.ItemLAND,
+				LHS:            timestamp,
+				RHS:            selected,
+				VectorMatching: &promql.VectorMatching{Card: promql.CardManyToMany},
+			},
+			Grouping: e.Grouping,
+		}, nil
+	case *keepMetricNamesExpr:
+		timestamp, err := newSelectorTimestampExpr(e.Call)
+		if err != nil {
+			return nil, err
+		}
+		call, ok := timestamp.(*promql.Call)
+		if !ok {
+			return nil, errors.Errorf("unexpected timestamp %s of %s", timestamp, e)
+		}
+		return newKeepMetricNamesExpr(call), nil
+	case *promql.Call:
+		call := *e
+		if name, ok := selectorTimestampFunctions[e.Func.Name]; ok {
+			fn := *e.Func
+			fn.Name = name
+			call.Func = &fn
+			return &call, nil
+		}
+		call.Args = make(promql.Expressions, len(e.Args))
+		for i, arg := range e.Args {
+			timestamp, err := newSelectorTimestampExpr(arg)
+			if err != nil {
+				return nil, err
+			}
+			call.Args[i] = timestamp
+		}
+		return &call, nil
+	}
+	return expr, nil
+}
+
+// newCrossSeriesSelectorExpr merges the first or last points of the series of a
+// group into the point of the earliest or latest timestamp, the op picks the
+// timestamp of the group, e.g. first by(host):
+// max by(host) (first_over_time(cpu_usage[1m]) and tfirst_over_time(cpu_usage[1m]) == on(host) group_left() min by(host) (tfirst_over_time(cpu_usage[1m]))).
+// Like InfluxQL the greatest value is selected between the points of the same time.
+func newCrossSeriesSelectorExpr(op promql.ItemType, expr promql.Expr, groups []string) (promql.Expr, error) {
+	timestamp, err := newSelectorTimestampExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	selected := &promql.BinaryExpr{
+		Op:  promql.ItemEQL,
+		LHS: timestamp,
+		RHS: &promql.AggregateExpr{
+			Op:       op,
+			Expr:     timestamp,
+			Grouping: groups,
+		},
+		VectorMatching: &promql.VectorMatching{
+			Card:           promql.CardManyToOne,
+			MatchingLabels: groups,
+			On:             true,
+		},
+	}
+	return &promql.AggregateExpr{
+		Op: promql.ItemMax,
+		Expr: &promql.BinaryExpr{
+			Op:             promql.ItemLAND,
+			LHS:            expr,
+			RHS:            selected,
+			VectorMatching: &promql.VectorMatching{Card: promql.CardManyToMany},
+		},
+		Grouping: groups,
+	}, nil
+}
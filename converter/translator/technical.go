@@ -0,0 +1,229 @@
+package translator
+
+import (
+	"time"
+
+	"github.com/influxdata/influxql"
+	"github.com/influxdata/promql/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	CALL_EMA  = "exponential_moving_average"
+	CALL_DEMA = "double_exponential_moving_average"
+	CALL_TEMA = "triple_exponential_moving_average"
+	CALL_RSI  = "relative_strength_index"
+	CALL_CMO  = "chande_momentum_oscillator"
+	CALL_KER  = "kaufmans_efficiency_ratio"
+	CALL_KAMA = "kaufmans_adaptive_moving_average"
+)
+
+const (
+	WARMUP_EXPONENTIAL = "exponential"
+	WARMUP_SIMPLE      = "simple"
+	WARMUP_NONE        = "none"
+)
+
+// TECHNICAL_ANALYSIS_FUNCTIONS are the InfluxQL technical analysis functions,
+// https://docs.influxdata.com/influxdb/v1/query_language/functions/#technical-analysis
+var TECHNICAL_ANALYSIS_FUNCTIONS Functions = []string{
+	CALL_EMA, CALL_DEMA, CALL_TEMA, CALL_RSI, CALL_CMO, CALL_KER, CALL_KAMA,
+}
+
+// getTechnicalAnalysisArgs parses the period, hold_period and warmup_type
+// arguments, e.g. exponential_moving_average(mean(x), 5, -1, 'exponential').
+func getTechnicalAnalysisArgs(op *influxql.Call) (promql.Expressions, error) {
+	if len(op.Args) < 2 || len(op.Args) > 4 {
+		return nil, errors.Errorf("%s requires 2 to 4 arguments: %s", op.Name, op)
+	}
+	period, ok := op.Args[1].(*influxql.IntegerLiteral)
+	if !ok || period.Val < 1 {
+		return nil, errors.Errorf("%s period must be a positive integer: %s", op.Name, op)
+	}
+	hold := int64(-1)
+	if len(op.Args) > 2 {
+		lit, ok := op.Args[2].(*influxql.IntegerLiteral)
+		if !ok {
+			return nil, errors.Errorf("%s hold period must be an integer: %s", op.Name, op)
+		}
+		hold = lit.Val
+	}
+	warmup := WARMUP_EXPONENTIAL
+	if op.Name == CALL_CMO {
+		warmup = WARMUP_NONE
+	}
+	if len(op.Args) > 3 {
+		lit, ok := op.Args[3].(*influxql.StringLiteral)
+		if !ok || op.Name == CALL_KER || op.Name == CALL_KAMA {
+			return nil, errors.Errorf("%s doesn't support warmup type argument: %s", op.Name, op)
+		}
+		switch lit.Val {
+		case WARMUP_EXPONENTIAL, WARMUP_SIMPLE, WARMUP_NONE:
+			warmup = lit.Val
+		default:
+			return nil, errors.Errorf("%s unknown warmup type %q", op.Name, lit.Val)
+		}
+	}
+	if hold < 0 {
+		hold = getDefaultHoldPeriod(op.Name, period.Val, warmup)
+	}
+	return promql.Expressions{
+		&promql.NumberLiteral{Val: float64(period.Val)},
+		&promql.NumberLiteral{Val: float64(hold)},
+		&promql.StringLiteral{Val: warmup},
+	}, nil
+}
+
+// getDefaultHoldPeriod returns the points InfluxQL holds back before returning
+// the results, which depends on the warmup type.
+func getDefaultHoldPeriod(name string, period int64, warmup string) int64 {
+	switch name {
+	case CALL_EMA, CALL_DEMA, CALL_TEMA:
+		if warmup == WARMUP_NONE {
+			return 0
+		}
+		times := map[string]int64{CALL_EMA: 1, CALL_DEMA: 2, CALL_TEMA: 3}[name]
+		return times * (period - 1)
+	}
+	return period
+}
+
+// newTechnicalAnalysisExpr composes the technical analysis function from the
+// MetricsQL smooth_exponential transform and rollups over subqueries at the
+// GROUP BY time() interval. Applied to raw points they are computed from the
+// values sampled at the query or subquery steps, as MetricsQL can't go through
+// each raw point.
+func (m *promQL) newTechnicalAnalysisExpr(op *AggrOperator, expr promql.Expr, interval time.Duration, aggregated bool) promql.Expr {
+	if !aggregated {
+		m.metadata.addWarning("%s of raw points is computed from the values sampled at the query or subquery steps instead of each point", op.Name)
+	}
+	period := op.Args[0].(*promql.NumberLiteral).Val
+	hold := int(op.Args[1].(*promql.NumberLiteral).Val)
+	warmup := op.Args[2].(*promql.StringLiteral).Val
+	if warmup == WARMUP_SIMPLE {
+		m.metadata.addWarning("%s simple warmup is approximated by exponential warmup", op.Name)
+	}
+	emaFactor := 2 / (period + 1)
+	window := interval * time.Duration(period)
+
+	var result promql.Expr
+	switch op.Name {
+	case CALL_EMA:
+		result = newSmoothExponentialExpr(expr, emaFactor)
+	case CALL_DEMA:
+		// DEMA = 2 * EMA - EMA(EMA)
+		ema := newSmoothExponentialExpr(expr, emaFactor)
+		result = newVectorBinaryExpr(promql.ItemSUB,
+			newNumberMulExpr(2, ema),
+			newSmoothExponentialExpr(ema, emaFactor))
+	case CALL_TEMA:
+		// TEMA = 3 * EMA - 3 * EMA(EMA) + EMA(EMA(EMA))
+		ema := newSmoothExponentialExpr(expr, emaFactor)
+		ema2 := newSmoothExponentialExpr(ema, emaFactor)
+		result = newVectorBinaryExpr(promql.ItemADD,
+			newVectorBinaryExpr(promql.ItemSUB, newNumberMulExpr(3, ema), newNumberMulExpr(3, ema2)),
+			newSmoothExponentialExpr(ema2, emaFactor))
+	case CALL_RSI:
+		// RSI = 100 * EMA(up) / (EMA(up) + EMA(down)), smoothed with Wilder's factor 1/period
+		up := newSmoothExponentialExpr(newUpMoveExpr(expr, interval), 1/period)
+		down := newSmoothExponentialExpr(newDownMoveExpr(expr, interval), 1/period)
+		result = newVectorBinaryExpr(promql.ItemDIV,
+			newNumberMulExpr(100, up),
+			&promql.ParenExpr{Expr: newVectorBinaryExpr(promql.ItemADD, up, down)})
+	case CALL_CMO:
+		// CMO = 100 * (sum(up) - sum(down)) / (sum(up) + sum(down)) of the last period points
+		up := newSumOverSubqueryExpr(newUpMoveExpr(expr, interval), window, interval)
+		down := newSumOverSubqueryExpr(newDownMoveExpr(expr, interval), window, interval)
+		result = newVectorBinaryExpr(promql.ItemDIV,
+			newNumberMulExpr(100, &promql.ParenExpr{Expr: newVectorBinaryExpr(promql.ItemSUB, up, down)}),
+			&promql.ParenExpr{Expr: newVectorBinaryExpr(promql.ItemADD, up, down)})
+	case CALL_KER:
+		result = newEfficiencyRatioExpr(expr, window, interval)
+	case CALL_KAMA:
+		m.metadata.addWarning("%s adaptive smoothing can't be reproduced, approximated by exponential moving average", op.Name)
+		result = newSmoothExponentialExpr(expr, emaFactor)
+	}
+	return m.holdBackExpr(op.Name, result, hold, interval)
+}
+
+// holdBackExpr drops the results of the first hold points of the time range.
+func (m *promQL) holdBackExpr(name string, expr promql.Expr, hold int, interval time.Duration) promql.Expr {
+	if hold <= 0 {
+		return expr
+	}
+	if m.timeRange == nil || m.timeRange.Min.IsZero() {
+		m.metadata.addWarning("%s hold period %d can't be applied without time range start", name, hold)
+		return expr
+	}
+	start := m.timeRange.Min.Add(interval * time.Duration(hold))
+	return &promql.BinaryExpr{
+		Op:  promql.ItemLAND,
+		LHS: expr,
+		RHS: &promql.BinaryExpr{
+			Op:  promql.ItemGTE,
+			LHS: newAggrExpr("vector", promql.ValueTypeScalar, promql.ValueTypeVector, newAggrExprWithArgs("time", nil, promql.ValueTypeScalar, nil)),
+			RHS: &promql.NumberLiteral{Val: float64(start.Unix())},
+		},
+		VectorMatching: &promql.VectorMatching{
+			Card: promql.CardManyToMany,
+			On:   true,
+		},
+	}
+}
+
+// newEfficiencyRatioExpr returns the ratio of the change over the period to
+// the sum of the absolute changes between each point.
+func newEfficiencyRatioExpr(expr promql.Expr, window, interval time.Duration) promql.Expr {
+	change := newAggrExpr("abs", promql.ValueTypeVector, promql.ValueTypeVector,
+		newAggrExpr("delta", promql.ValueTypeMatrix, promql.ValueTypeVector, newStepSubqueryExpr(expr, window, interval)))
+	volatility := newSumOverSubqueryExpr(
+		newAggrExpr("abs", promql.ValueTypeVector, promql.ValueTypeVector, newStepDeltaExpr(expr, interval)),
+		window, interval)
+	return newVectorBinaryExpr(promql.ItemDIV, change, volatility)
+}
+
+// https://docs.victoriametrics.com/MetricsQL.html#smooth_exponential
+func newSmoothExponentialExpr(expr promql.Expr, factor float64) promql.Expr {
+	return newAggrExprWithArgs("smooth_exponential",
+		[]promql.ValueType{promql.ValueTypeVector, promql.ValueTypeScalar},
+		promql.ValueTypeVector,
+		promql.Expressions{expr, &promql.NumberLiteral{Val: factor}})
+}
+
+func newUpMoveExpr(expr promql.Expr, interval time.Duration) promql.Expr {
+	return newAggrExprWithArgs("clamp_min",
+		[]promql.ValueType{promql.ValueTypeVector, promql.ValueTypeScalar},
+		promql.ValueTypeVector,
+		promql.Expressions{newStepDeltaExpr(expr, interval), &promql.NumberLiteral{Val: 0}})
+}
+
+func newDownMoveExpr(expr promql.Expr, interval time.Duration) promql.Expr {
+	return &promql.UnaryExpr{
+		Op: promql.ItemSUB,
+		Expr: newAggrExprWithArgs("clamp_max",
+			[]promql.ValueType{promql.ValueTypeVector, promql.ValueTypeScalar},
+			promql.ValueTypeVector,
+			promql.Expressions{newStepDeltaExpr(expr, interval), &promql.NumberLiteral{Val: 0}}),
+	}
+}
+
+func newSumOverSubqueryExpr(expr promql.Expr, window, interval time.Duration) promql.Expr {
+	return newAggrExpr("sum_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, newStepSubqueryExpr(expr, window, interval))
+}
+
+func newNumberMulExpr(num float64, expr promql.Expr) promql.Expr {
+	return &promql.BinaryExpr{
+		Op:  promql.ItemMUL,
+		LHS: &promql.NumberLiteral{Val: num},
+		RHS: expr,
+	}
+}
+
+func newVectorBinaryExpr(op promql.ItemType, lhs, rhs promql.Expr) promql.Expr {
+	return &promql.BinaryExpr{
+		Op:             op,
+		LHS:            lhs,
+		RHS:            rhs,
+		VectorMatching: getVectorMatching(lhs),
+	}
+}
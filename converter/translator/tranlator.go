@@ -1,8 +1,53 @@
 package translator
 
-import "github.com/influxdata/influxql"
+import (
+	"fmt"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
 
 type Translator interface {
 	Translate(s influxql.Statement) (string, error)
 	GetTimeRange() *influxql.TimeRange
+	GetMetadata() *Metadata
+}
+
+// Metadata describes how the InfluxQL statement is translated.
+type Metadata struct {
+	// Warnings reports the InfluxQL semantics which can't be reproduced
+	Warnings []string
+	// NameMapping maps the InfluxQL names to the sanitized or escaped names of
+	// the MetricsQL expression, e.g. project_tags.0.0.key => project_tags\.0\.0\.key
+	NameMapping map[string]string
+	// GroupByInterval is the interval of GROUP BY time(), the start and step of
+	// the query should be aligned to it like the InfluxDB buckets.
+	GroupByInterval time.Duration
+	// GroupByOffset is the offset of GROUP BY time() in [0, GroupByInterval).
+	// The rollup windows are shifted forward by it through MetricsQL offset,
+	// so the points at the multiples of GroupByInterval end at the InfluxDB
+	// bucket boundaries.
+	GroupByOffset time.Duration
+	// Fill is the fill() option applied to the GROUP BY time() buckets, the
+	// empty buckets of influxql.NullFill and influxql.NoFill are left as gaps
+	Fill influxql.FillOption
+	// FillValue is the value of influxql.NumberFill
+	FillValue float64
+}
+
+func newMetadata() *Metadata {
+	return &Metadata{
+		Warnings:    make([]string, 0),
+		NameMapping: make(map[string]string),
+	}
+}
+
+func (m *Metadata) addWarning(format string, args ...interface{}) {
+	m.Warnings = append(m.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (m *Metadata) addNameMapping(name string, mapped string) {
+	if name != mapped {
+		m.NameMapping[name] = mapped
+	}
 }
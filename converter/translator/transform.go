@@ -0,0 +1,299 @@
+package translator
+
+import (
+	"time"
+
+	"github.com/influxdata/promql/v2"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	CALL_CUMULATIVE_SUM        = "cumulative_sum"
+	CALL_ELAPSED               = "elapsed"
+	CALL_HOLT_WINTERS          = "holt_winters"
+	CALL_HOLT_WINTERS_WITH_FIT = "holt_winters_with_fit"
+	CALL_MOVING_AVERAGE        = "moving_average"
+
+	CALL_DERIVATIVE              = "derivative"
+	CALL_NON_NEGATIVE_DERIVATIVE = "non_negative_derivative"
+	CALL_DIFFERENCE              = "difference"
+	CALL_NON_NEGATIVE_DIFFERENCE = "non_negative_difference"
+)
+
+const (
+	// HOLT_WINTERS_SMOOTHING_FACTOR and HOLT_WINTERS_TREND_FACTOR are the
+	// factors of MetricsQL holt_winters, which InfluxQL fits from the data
+	HOLT_WINTERS_SMOOTHING_FACTOR = 0.5
+	HOLT_WINTERS_TREND_FACTOR     = 0.5
+	// HOLT_WINTERS_MIN_POINTS is the minimum count of intervals holt_winters smooths over
+	HOLT_WINTERS_MIN_POINTS = 10
+)
+
+// TRANSFORM_FUNCTIONS are the InfluxQL transformations applied to the series
+// of raw points or aggregated results, e.g. cumulative_sum(mean("field")).
+var TRANSFORM_FUNCTIONS Functions = []string{
+	CALL_CUMULATIVE_SUM, CALL_ELAPSED,
+	CALL_HOLT_WINTERS, CALL_HOLT_WINTERS_WITH_FIT,
+	CALL_MOVING_AVERAGE,
+	CALL_DERIVATIVE, CALL_NON_NEGATIVE_DERIVATIVE,
+	CALL_DIFFERENCE, CALL_NON_NEGATIVE_DIFFERENCE,
+}
+
+type Functions []string
+
+func (fs Functions) Has(name string) bool {
+	for _, f := range fs {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isTransformOperator(name string) bool {
+	return MATH_FUNCTIONS.Has(name) || TRANSFORM_FUNCTIONS.Has(name) || TECHNICAL_ANALYSIS_FUNCTIONS.Has(name)
+}
+
+// splitTransformOperators splits the leading transformations, which are
+// applied to the aggregated results, from the aggregate operators consuming
+// the points.
+func splitTransformOperators(ops []*AggrOperator) ([]*AggrOperator, []*AggrOperator) {
+	for i, op := range ops {
+		if !isTransformOperator(op.Name) {
+			return ops[:i], ops[i:]
+		}
+	}
+	return ops, nil
+}
+
+// applyTransformOperators applies the transformations from the innermost one
+// to the series of each GROUP BY time() interval, or to the raw points when
+// aggregated is false.
+func (m *promQL) applyTransformOperators(ops []*AggrOperator, expr promql.Expr, interval time.Duration, aggregated bool) (promql.Expr, error) {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		if MATH_FUNCTIONS.Has(op.Name) {
+			// the metric names are kept for raw points as InfluxQL keeps the series identity
+			expr = newMathExpr(op, expr, !aggregated)
+			continue
+		}
+		var err error
+		expr, err = m.newTransformExpr(op, expr, interval, aggregated)
+		if err != nil {
+			return nil, errors.Wrapf(err, "transform %s", op.Name)
+		}
+	}
+	return expr, nil
+}
+
+func (m *promQL) newTransformExpr(op *AggrOperator, expr promql.Expr, interval time.Duration, aggregated bool) (promql.Expr, error) {
+	switch op.Name {
+	case CALL_CUMULATIVE_SUM:
+		// https://docs.victoriametrics.com/MetricsQL.html#running_sum
+		return newAggrExpr("running_sum", promql.ValueTypeVector, promql.ValueTypeVector, expr), nil
+	case CALL_ELAPSED:
+		return m.newElapsedExpr(op, expr, interval, aggregated)
+	case CALL_DERIVATIVE, CALL_NON_NEGATIVE_DERIVATIVE, CALL_DIFFERENCE, CALL_NON_NEGATIVE_DIFFERENCE:
+		return newDerivativeExpr(op, expr, interval, aggregated), nil
+	case CALL_MOVING_AVERAGE:
+		// moving_average(mean(x), N) averages the last N points at the GROUP BY time() interval:
+		// avg_over_time((avg(avg_over_time(x[1m])))[5m:1m])
+		n := time.Duration(op.Args[0].(*promql.NumberLiteral).Val)
+		if !aggregated {
+			// the raw points are sampled at the steps of the subquery
+			m.metadata.addWarning("%s of raw points averages the values at %s steps instead of the last %d points", op.Name, model.Duration(interval), n)
+		}
+		return newAggrExpr("avg_over_time", promql.ValueTypeMatrix, promql.ValueTypeVector, newStepSubqueryExpr(expr, n*interval, interval)), nil
+	case CALL_HOLT_WINTERS, CALL_HOLT_WINTERS_WITH_FIT:
+		if !aggregated {
+			return nil, errors.Errorf("%s requires an aggregate function", op.Name)
+		}
+		return m.newHoltWintersExpr(op, expr, interval), nil
+	}
+	if TECHNICAL_ANALYSIS_FUNCTIONS.Has(op.Name) {
+		return m.newTechnicalAnalysisExpr(op, expr, interval, aggregated), nil
+	}
+	return nil, errors.Errorf("not supported transformation %q", op.Name)
+}
+
+// newElapsedExpr translates elapsed(x, unit) to the interval between
+// subsequent points in units. MetricsQL can't return the previous point of each
+// raw point, so the raw points are approximated by the average interval between
+// the points of the lookbehind window, which is reported as a warning:
+// scrape_interval(x[1m]) * 1e+09. Applied to aggregated results InfluxQL simply
+// returns the GROUP BY time() interval for each point.
+func (m *promQL) newElapsedExpr(op *AggrOperator, expr promql.Expr, interval time.Duration, aggregated bool) (promql.Expr, error) {
+	unit := op.Unit
+	if unit == 0 {
+		unit = time.Nanosecond
+	}
+	if aggregated {
+		return &promql.BinaryExpr{
+			Op: promql.ItemADD,
+			LHS: &promql.BinaryExpr{
+				Op:  promql.ItemMUL,
+				LHS: parenIfBinaryExpr(expr),
+				RHS: &promql.NumberLiteral{Val: 0},
+			},
+			RHS: &promql.NumberLiteral{Val: float64(interval) / float64(unit)},
+		}, nil
+	}
+	m.metadata.addWarning("%s of raw points is approximated by the average interval between the points over %s", op.Name, model.Duration(interval))
+	// https://docs.victoriametrics.com/MetricsQL.html#scrape_interval
+	elapsed := newAggrExpr("scrape_interval", promql.ValueTypeMatrix, promql.ValueTypeVector, newRawRangeExpr(expr, interval))
+	return newScaleExpr(elapsed, float64(time.Second)/float64(unit)), nil
+}
+
+// newDerivativeExpr translates the derivative family by their point to point
+// definitions. The aggregated results are differenced between each GROUP BY
+// time() interval with delta over the subquery, which takes the previous point
+// before the window into account, and derivatives are scaled from the interval
+// to the unit: non_negative_derivative(mean(x), 1s) GROUP BY time(1m) equals
+// delta((avg(avg_over_time(x[1m])))[1m:1m]) / 60 >= 0. The raw points are
+// differenced with idelta and ideriv between the last two points.
+func newDerivativeExpr(op *AggrOperator, expr promql.Expr, interval time.Duration, aggregated bool) promql.Expr {
+	unit := op.Unit
+	if unit == 0 {
+		unit = time.Second
+	}
+	isDerivative := op.Name == CALL_DERIVATIVE || op.Name == CALL_NON_NEGATIVE_DERIVATIVE
+
+	var result promql.Expr
+	if aggregated {
+		result = newStepDeltaExpr(expr, interval)
+		if isDerivative {
+			result = newUnitScaleExpr(result, interval, unit)
+		}
+	} else {
+		if isDerivative {
+			// https://docs.victoriametrics.com/MetricsQL.html#ideriv
+			result = newAggrExpr("ideriv", promql.ValueTypeMatrix, promql.ValueTypeVector, newRawRangeExpr(expr, interval))
+			result = newUnitScaleExpr(result, time.Second, unit)
+		} else {
+			// https://docs.victoriametrics.com/MetricsQL.html#idelta
+			result = newAggrExpr("idelta", promql.ValueTypeMatrix, promql.ValueTypeVector, newRawRangeExpr(expr, interval))
+		}
+	}
+	if op.Name == CALL_NON_NEGATIVE_DERIVATIVE || op.Name == CALL_NON_NEGATIVE_DIFFERENCE {
+		result = &promql.BinaryExpr{
+			Op:  promql.ItemGTE,
+			LHS: result,
+			RHS: &promql.NumberLiteral{Val: 0},
+		}
+	}
+	return result
+}
+
+// newRawRangeExpr selects the raw points of the series in the window.
+func newRawRangeExpr(expr promql.Expr, window time.Duration) promql.Expr {
+	if ms, ok := toMatrixSelector(expr, window); ok {
+		return ms
+	}
+	return newStepSubqueryExpr(expr, window, 0)
+}
+
+// newStepSubqueryExpr returns the subquery of the series at each interval.
+func newStepSubqueryExpr(expr promql.Expr, window, interval time.Duration) promql.Expr {
+	return &promql.SubqueryExpr{
+		Expr:  &promql.ParenExpr{Expr: expr},
+		Range: window,
+		Step:  interval,
+	}
+}
+
+// newStepDeltaExpr returns the difference between each point and the previous
+// one, MetricsQL delta takes the last point before the window into account.
+func newStepDeltaExpr(expr promql.Expr, interval time.Duration) promql.Expr {
+	return newAggrExpr("delta", promql.ValueTypeMatrix, promql.ValueTypeVector, newStepSubqueryExpr(expr, interval, interval))
+}
+
+// newUnitScaleExpr converts the value changed per the duration to the value
+// changed per the unit.
+func newUnitScaleExpr(expr promql.Expr, per, unit time.Duration) promql.Expr {
+	switch {
+	case per == unit:
+		return expr
+	case per > unit:
+		return &promql.BinaryExpr{
+			Op:  promql.ItemDIV,
+			LHS: parenIfBinaryExpr(expr),
+			RHS: &promql.NumberLiteral{Val: float64(per) / float64(unit)},
+		}
+	}
+	return newScaleExpr(expr, float64(unit)/float64(per))
+}
+
+// newScaleExpr multiplies the expression by the factor, e.g. to convert per
+// second values to the unit of InfluxQL functions.
+func newScaleExpr(expr promql.Expr, factor float64) promql.Expr {
+	if factor == 1 {
+		return expr
+	}
+	return &promql.BinaryExpr{
+		Op:  promql.ItemMUL,
+		LHS: parenIfBinaryExpr(expr),
+		RHS: &promql.NumberLiteral{Val: factor},
+	}
+}
+
+// newHoltWintersExpr translates holt_winters(mean(x), N, S) to the MetricsQL
+// holt_winters over the series of each GROUP BY time() interval:
+// holt_winters((avg(avg_over_time(x[1m])))[10m:1m], 0.5, 0.5).
+// InfluxQL fits the smoothing and trend factors and the seasonality, while
+// MetricsQL takes fixed factors and has no seasonality. MetricsQL holt_winters
+// returns the smoothed value at the last point and doesn't extrapolate the trend,
+// so the N points InfluxQL predicts can't be reproduced: the time range is only
+// extended by N intervals, whose points hold the last smoothed value. Both
+// holt_winters and holt_winters_with_fit return the smoothed points of the time
+// range. All of these are reported as warnings.
+func (m *promQL) newHoltWintersExpr(op *AggrOperator, expr promql.Expr, interval time.Duration) promql.Expr {
+	n := int(op.Args[0].(*promql.NumberLiteral).Val)
+	season := int(op.Args[1].(*promql.NumberLiteral).Val)
+	if season > 1 {
+		m.metadata.addWarning("%s seasonal pattern %d can't be reproduced, MetricsQL holt_winters has no seasonality", op.Name, season)
+	}
+	m.metadata.addWarning("%s smoothing factor and trend factor are fixed to %v and %v instead of fitted", op.Name, HOLT_WINTERS_SMOOTHING_FACTOR, HOLT_WINTERS_TREND_FACTOR)
+	m.metadata.addWarning("%s forecast of %d points can't be reproduced, MetricsQL holt_winters doesn't extrapolate the trend and the points after the time range hold the last smoothed value", op.Name, n)
+
+	forecast := interval * time.Duration(n)
+	if forecast > m.forecast {
+		m.forecast = forecast
+	}
+
+	points := HOLT_WINTERS_MIN_POINTS
+	if n > points {
+		points = n
+	}
+	if 2*season > points {
+		points = 2 * season
+	}
+	return newAggrExprWithArgs("holt_winters",
+		[]promql.ValueType{
+			promql.ValueTypeMatrix,
+			promql.ValueTypeScalar,
+			promql.ValueTypeScalar,
+		}, promql.ValueTypeVector,
+		promql.Expressions{
+			&promql.SubqueryExpr{
+				Expr:  &promql.ParenExpr{Expr: expr},
+				Range: interval * time.Duration(points),
+				Step:  interval,
+			},
+			&promql.NumberLiteral{Val: HOLT_WINTERS_SMOOTHING_FACTOR},
+			&promql.NumberLiteral{Val: HOLT_WINTERS_TREND_FACTOR},
+		})
+}
+
+// extendForecastTimeRange extends the end of the time range by the intervals
+// InfluxQL holt_winters predicts.
+func (m *promQL) extendForecastTimeRange() {
+	if m.forecast == 0 {
+		return
+	}
+	if m.timeRange == nil || m.timeRange.Max.IsZero() {
+		m.metadata.addWarning("time range isn't bounded, it can't be extended by %s", model.Duration(m.forecast))
+		return
+	}
+	m.timeRange.Max = m.timeRange.Max.Add(m.forecast)
+}